@@ -0,0 +1,206 @@
+package iprepd
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// aggregateMembers is the stored form of an aggregate reputation, such as the
+// reputation of a network or an email domain. It holds the reputation entries for
+// the member objects that violations were applied to, keyed by object.
+type aggregateMembers map[string]Reputation
+
+func (m aggregateMembers) decode(buf []byte) error {
+	if buf == nil {
+		return nil
+	}
+	return json.Unmarshal(buf, &m)
+}
+
+// reputation returns the aggregate reputation, which is the mean reputation of the
+// members that have not yet recovered. If fewer than min members have not
+// recovered, ok is false.
+func (m aggregateMembers) reputation(min int) (ret Reputation, ok bool) {
+	var (
+		sum int
+		n   int
+	)
+	for _, r := range m {
+		err := r.applyDecay()
+		if err != nil || r.Reputation >= 100 {
+			continue
+		}
+		sum += r.Reputation
+		n++
+		if r.LastUpdated.After(ret.LastUpdated) {
+			ret.LastUpdated = r.LastUpdated
+		}
+	}
+	if n == 0 || n < min {
+		return ret, false
+	}
+	ret.Reputation = sum / n
+	return ret, true
+}
+
+// prune removes members that have recovered, and if there are more than max
+// members removes those that were updated least recently. It returns how long the
+// aggregate should be retained for, which is as long as the longest retained
+// member.
+func (m aggregateMembers) prune(max int) time.Duration {
+	var (
+		keys   []string
+		expiry time.Duration
+	)
+	for k, r := range m {
+		d := r
+		if d.applyDecay() != nil || d.Reputation >= 100 {
+			delete(m, k)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) > max {
+		sort.Slice(keys, func(i, j int) bool {
+			return m[keys[i]].LastUpdated.Before(m[keys[j]].LastUpdated)
+		})
+		for _, k := range keys[:len(keys)-max] {
+			delete(m, k)
+		}
+	}
+	for _, r := range m {
+		if e := r.expiry(); e > expiry {
+			expiry = e
+		}
+	}
+	if expiry == 0 {
+		// Nothing is left in the aggregate, so allow it to expire shortly
+		expiry = sruntime.cfg.Retention.Recovered
+	}
+	return expiry
+}
+
+// aggregateUpdate updates the aggregate reputations that the objects in reps are
+// members of, with keyFn returning the key of the aggregate for an object. Entries
+// in reps with a nil value remove the object from the aggregate. No more than max
+// members are kept in each aggregate.
+//
+// Each aggregate is updated separately, since an aggregate for a busy network or
+// domain can be modified often by concurrent requests. Contention on one aggregate
+// then only causes that aggregate to be retried, and a failure to update it does
+// not prevent the other aggregates from being updated. The first error is
+// returned.
+func aggregateUpdate(reps map[string]*Reputation, keyFn func(string) (string, error), max int) error {
+	var (
+		keys    []string
+		keyIdx  = make(map[string]int)
+		members [][]string
+	)
+	for obj := range reps {
+		k, err := keyFn(obj)
+		if err != nil {
+			return err
+		}
+		idx, ok := keyIdx[k]
+		if !ok {
+			idx = len(keys)
+			keyIdx[k] = idx
+			keys = append(keys, k)
+			members = append(members, nil)
+		}
+		members[idx] = append(members[idx], obj)
+	}
+	var ret error
+	for i, k := range keys {
+		err := aggregateUpdateKey(k, members[i], reps, max)
+		if err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// aggregateUpdateKey updates the aggregate reputation stored under key for the
+// objects in members, using their entries in reps
+func aggregateUpdateKey(key string, members []string, reps map[string]*Reputation, max int) error {
+	return sruntime.store.Update([]string{key}, func(_ int, cur []byte) (StoreValue, error) {
+		m := make(aggregateMembers)
+		// If the existing entry can't be decoded, replace it rather than failing
+		if m.decode(cur) != nil {
+			m = make(aggregateMembers)
+		}
+		for _, obj := range members {
+			r := reps[obj]
+			if r == nil {
+				delete(m, obj)
+				continue
+			}
+			// Only the fields required to calculate the reputation are kept
+			m[obj] = Reputation{
+				Object:      r.Object,
+				Type:        r.Type,
+				Reputation:  r.Reputation,
+				LastUpdated: r.LastUpdated,
+				DecayAfter:  r.DecayAfter,
+				Decay:       r.Decay,
+				Pinned:      r.Pinned,
+				PinExpires:  r.PinExpires,
+			}
+		}
+		expiry := m.prune(max)
+		buf, err := json.Marshal(m)
+		if err != nil {
+			return StoreValue{}, err
+		}
+		return StoreValue{Value: buf, Expiry: expiry}, nil
+	})
+}
+
+// aggregateRecord returns the results of violations applied to objects of type
+// typestr that should be recorded in aggregate reputations, keyed by object
+func aggregateRecord(applied []appliedViolation, typestr string) map[string]*Reputation {
+	reps := make(map[string]*Reputation)
+	for i := range applied {
+		a := &applied[i]
+		// Pinned objects don't contribute to aggregate reputations
+		if a.Err != nil || a.Duplicate || a.Result.Type != typestr || a.Result.IsPinned() {
+			continue
+		}
+		reps[a.Result.Object] = &a.Result
+	}
+	return reps
+}
+
+// aggregateGet returns the aggregate reputation stored under key, requiring at
+// least min members that have not recovered. If there is no aggregate reputation,
+// ErrNotFound is returned.
+func aggregateGet(key string, min int) (ret Reputation, err error) {
+	buf, err := sruntime.store.Get(key)
+	if err != nil {
+		return
+	}
+	m := make(aggregateMembers)
+	err = m.decode(buf)
+	if err != nil {
+		return
+	}
+	ret, ok := m.reputation(min)
+	if !ok {
+		return ret, ErrNotFound
+	}
+	return ret, nil
+}
+
+// aggregateRemove removes an object from any aggregate reputation it is a member
+// of, such as the reputation for the network enclosing an ip address or the domain
+// of an email address
+func aggregateRemove(typestr string, valstr string) error {
+	switch typestr {
+	case TypeIP:
+		return subnetRemove(valstr)
+	case TypeEmail:
+		return domainRemove(valstr)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package iprepd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregateMembersPrune(t *testing.T) {
+	origDecay := sruntime.cfg.Decay
+	defer func() {
+		sruntime.cfg.Decay = origDecay
+	}()
+	sruntime.cfg.Decay.Points = 1
+	sruntime.cfg.Decay.Interval = time.Minute
+
+	now := time.Now().UTC()
+	m := aggregateMembers{
+		"10.0.0.1": {Object: "10.0.0.1", Type: TypeIP, Reputation: 50, LastUpdated: now.Add(-time.Minute * 10)},
+		"10.0.0.2": {Object: "10.0.0.2", Type: TypeIP, Reputation: 50, LastUpdated: now.Add(-time.Hour * 2)},
+		"10.0.0.3": {Object: "10.0.0.3", Type: TypeIP, Reputation: 50, LastUpdated: now.Add(-time.Minute * 20)},
+		"10.0.0.4": {Object: "10.0.0.4", Type: TypeIP, Reputation: 50, LastUpdated: now.Add(-time.Minute * 30)},
+	}
+	expiry := m.prune(2)
+	// 10.0.0.2 has recovered and 10.0.0.4 is the oldest remaining address
+	assert.Equal(t, 2, len(m))
+	_, ok := m["10.0.0.1"]
+	assert.True(t, ok)
+	_, ok = m["10.0.0.3"]
+	assert.True(t, ok)
+	assert.InDelta(t, float64(time.Minute*40+sruntime.cfg.Retention.Recovered), float64(expiry),
+		float64(time.Second))
+}
@@ -2,6 +2,7 @@ package iprepd
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"errors"
 	"io"
@@ -15,15 +16,18 @@ import (
 	"go.mozilla.org/hawk"
 )
 
+// principalKey is the request context key used to store the authenticated principal
+type principalKey struct{}
+
 func auth(rf func(http.ResponseWriter, *http.Request), needsWrite bool) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if !sruntime.cfg.Auth.DisableAuth {
 			hdr := r.Header.Get("Authorization")
-			v, wr := false, false
+			v, wr, p := false, false, ""
 			if strings.HasPrefix(hdr, "Hawk ") {
-				v, wr = hawkAuth(r)
+				v, wr, p = hawkAuth(r)
 			} else if strings.HasPrefix(hdr, "APIKey ") {
-				v, wr = apiAuth(r)
+				v, wr, p = apiAuth(r)
 			}
 			if !v {
 				w.WriteHeader(http.StatusUnauthorized)
@@ -33,28 +37,37 @@ func auth(rf func(http.ResponseWriter, *http.Request), needsWrite bool) func(htt
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
 		}
 		rf(w, r)
 	}
 }
 
-func apiAuth(r *http.Request) (bool, bool) {
+// requestPrincipal returns the name of the principal that authenticated the
+// request, which is the API key name or Hawk ID. If authentication is disabled an
+// empty string is returned.
+func requestPrincipal(r *http.Request) string {
+	p, _ := r.Context().Value(principalKey{}).(string)
+	return p
+}
+
+func apiAuth(r *http.Request) (bool, bool, string) {
 	hdr := r.Header.Get("Authorization")
 	hdr = strings.TrimPrefix(hdr, "APIKey ")
-	for _, v := range sruntime.cfg.Auth.APIKey {
+	for k, v := range sruntime.cfg.Auth.APIKey {
 		if hdr == v {
-			return true, true
+			return true, true, k
 		}
 	}
-	for _, v := range sruntime.cfg.Auth.ROAPIKey {
+	for k, v := range sruntime.cfg.Auth.ROAPIKey {
 		if hdr == v {
-			return true, false
+			return true, false, k
 		}
 	}
-	return false, false
+	return false, false, ""
 }
 
-func hawkAuth(r *http.Request) (bool, bool) {
+func hawkAuth(r *http.Request) (bool, bool, string) {
 
 	wr := false
 
@@ -80,19 +93,19 @@ func hawkAuth(r *http.Request) (bool, bool) {
 	auth, err := hawk.NewAuthFromRequest(r, credsLookupFunc, nonceCheckFunc)
 	if err != nil {
 		log.Warnf(err.Error())
-		return false, false
+		return false, false, ""
 	}
 
 	err = auth.Valid()
 	if err != nil {
 		log.Warnf(err.Error())
-		return false, false
+		return false, false, ""
 	}
 
 	contentType := r.Header.Get("Content-Type")
 	if r.Method != "GET" && r.Method != "DELETE" && contentType == "" {
 		log.Warnf("hawk: missing content-type")
-		return false, false
+		return false, false, ""
 	}
 
 	var mediaType string
@@ -100,13 +113,13 @@ func hawkAuth(r *http.Request) (bool, bool) {
 		mediaType, _, err = mime.ParseMediaType(contentType)
 		if err != nil && contentType != "" {
 			log.Warnf(err.Error())
-			return false, false
+			return false, false, ""
 		}
 
 		buf, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			log.Warnf(err.Error())
-			return false, false
+			return false, false, ""
 		}
 
 		r.Body = ioutil.NopCloser(bytes.NewBuffer(buf))
@@ -114,9 +127,9 @@ func hawkAuth(r *http.Request) (bool, bool) {
 		io.Copy(hash, ioutil.NopCloser(bytes.NewBuffer(buf)))
 		if !auth.ValidHash(hash) {
 			log.Warnf("hawk: invalid payload hash")
-			return false, false
+			return false, false, ""
 		}
 	}
 
-	return true, wr
+	return true, wr, auth.Credentials.ID
 }
@@ -0,0 +1,76 @@
+package iprepd
+
+import (
+	"fmt"
+)
+
+// Band is a named range of reputation scores, along with the action consumers
+// should take for objects with a reputation in the range
+type Band struct {
+	// Name is the name of the band, for example allow, challenge or block
+	Name string `json:"name"`
+
+	// Min and Max are the lowest and highest reputation scores in the band,
+	// inclusive
+	Min int `json:"min"`
+	Max int `json:"max"`
+
+	// Action is the recommended action for objects in the band, and defaults to
+	// the name of the band
+	Action string `json:"action,omitempty"`
+}
+
+// validateBands validates a list of bands, setting the default action for any
+// band that does not have one
+func validateBands(bands []Band) error {
+	for i := range bands {
+		b := &bands[i]
+		if b.Name == "" {
+			return fmt.Errorf("band missing required field name")
+		}
+		if b.Min < 0 || b.Max > 100 || b.Min > b.Max {
+			return fmt.Errorf("invalid score range for band %v", b.Name)
+		}
+		if b.Action == "" {
+			b.Action = b.Name
+		}
+		for _, x := range bands[:i] {
+			if x.Name == b.Name {
+				return fmt.Errorf("duplicate band %v", b.Name)
+			}
+			if b.Min <= x.Max && x.Min <= b.Max {
+				return fmt.Errorf("band %v overlaps band %v", b.Name, x.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// bands returns the bands that apply to objects of type typestr. Bands configured
+// for the type replace the default bands.
+func (cfg *ServerCfg) bands(typestr string) []Band {
+	if b, ok := cfg.Bands.Types[typestr]; ok {
+		return b
+	}
+	return cfg.Bands.Default
+}
+
+// band returns the band a reputation score of rep falls in for objects of type
+// typestr, or nil if the score is not in any band
+func (cfg *ServerCfg) band(typestr string, rep int) *Band {
+	for _, b := range cfg.bands(typestr) {
+		if rep >= b.Min && rep <= b.Max {
+			return &b
+		}
+	}
+	return nil
+}
+
+// applyBand sets the band and recommended action for the reputation based on its
+// current score
+func (r *Reputation) applyBand() {
+	r.Band, r.Action = "", ""
+	if b := sruntime.cfg.band(r.Type, r.Reputation); b != nil {
+		r.Band, r.Action = b.Name, b.Action
+	}
+}
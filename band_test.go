@@ -0,0 +1,127 @@
+package iprepd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateBands(t *testing.T) {
+	tests := []struct {
+		Bands []Band
+		Valid bool
+	}{
+		{nil, true},
+		{[]Band{{Name: "block", Min: 0, Max: 49}, {Name: "allow", Min: 50, Max: 100}}, true},
+		{[]Band{{Name: "block", Min: 0, Max: 10}}, true},
+		{[]Band{{Min: 0, Max: 100}}, false},
+		{[]Band{{Name: "block", Min: 50, Max: 10}}, false},
+		{[]Band{{Name: "block", Min: -1, Max: 10}}, false},
+		{[]Band{{Name: "block", Min: 0, Max: 101}}, false},
+		{[]Band{{Name: "block", Min: 0, Max: 50}, {Name: "allow", Min: 50, Max: 100}}, false},
+		{[]Band{{Name: "block", Min: 0, Max: 10}, {Name: "block", Min: 20, Max: 30}}, false},
+	}
+	for i, tst := range tests {
+		err := validateBands(tst.Bands)
+		assert.Equal(t, tst.Valid, err == nil, i)
+	}
+
+	b := []Band{{Name: "block", Min: 0, Max: 49, Action: "deny"}, {Name: "allow", Min: 50, Max: 100}}
+	assert.Nil(t, validateBands(b))
+	assert.Equal(t, "deny", b[0].Action)
+	assert.Equal(t, "allow", b[1].Action)
+}
+
+func TestReputationBand(t *testing.T) {
+	sruntime.cfg.Bands.Default = []Band{
+		{Name: "block", Min: 0, Max: 49, Action: "block"},
+		{Name: "challenge", Min: 50, Max: 79, Action: "captcha"},
+		{Name: "allow", Min: 80, Max: 100, Action: "allow"},
+	}
+	sruntime.cfg.Bands.Types = map[string][]Band{
+		TypeEmail: {{Name: "block", Min: 0, Max: 20, Action: "block"}},
+	}
+	defer func() {
+		sruntime.cfg.Bands.Default = nil
+		sruntime.cfg.Bands.Types = nil
+	}()
+
+	tests := []struct {
+		Type       string
+		Reputation int
+		Band       string
+		Action     string
+	}{
+		{TypeIP, 0, "block", "block"},
+		{TypeIP, 49, "block", "block"},
+		{TypeIP, 50, "challenge", "captcha"},
+		{TypeIP, 100, "allow", "allow"},
+		{TypeEmail, 20, "block", "block"},
+		{TypeEmail, 50, "", ""},
+	}
+	for _, tst := range tests {
+		r := Reputation{Type: tst.Type, Reputation: tst.Reputation, Band: "stale"}
+		r.applyBand()
+		assert.Equal(t, tst.Band, r.Band)
+		assert.Equal(t, tst.Action, r.Action)
+	}
+}
+
+func TestReputationBandResponses(t *testing.T) {
+	assert.Nil(t, baseTest())
+	sruntime.cfg.Bands.Default = []Band{
+		{Name: "block", Min: 0, Max: 49, Action: "block"},
+		{Name: "allow", Min: 50, Max: 100, Action: "allow"},
+	}
+	origDisableAuth := sruntime.cfg.Auth.DisableAuth
+	sruntime.cfg.Auth.DisableAuth = true
+	defer func() {
+		sruntime.cfg.Bands.Default = nil
+		sruntime.cfg.Auth.DisableAuth = origDisableAuth
+	}()
+	h := mwHandler(newRouter())
+
+	// A band included in a PUT should not be stored
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", "/type/ip/192.168.50.1",
+		bytes.NewReader([]byte(`{"reputation":30,"band":"allow","action":"allow"}`)))
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	buf, err := sruntime.store.Get("ip 192.168.50.1")
+	assert.Nil(t, err)
+	assert.NotContains(t, string(buf), "band")
+	assert.NotContains(t, string(buf), "action")
+
+	// The band should be computed from the score in lookups and dumps
+	recorder = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/type/ip/192.168.50.1", nil)
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var r Reputation
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &r))
+	assert.Equal(t, "block", r.Band)
+	assert.Equal(t, "block", r.Action)
+
+	recorder = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/dump", nil)
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var reps []Reputation
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &reps))
+	found := 0
+	for _, x := range reps {
+		switch x.Object {
+		case "192.168.50.1":
+			assert.Equal(t, "block", x.Band)
+			found++
+		case "192.168.0.1":
+			assert.Equal(t, "allow", x.Band)
+			found++
+		}
+	}
+	assert.Equal(t, 2, found)
+}
@@ -0,0 +1,88 @@
+package iprepd
+
+import (
+	"fmt"
+	"time"
+)
+
+// PenaltyBudget limits the total number of reputation points an object can lose
+// to violations within a sliding window
+type PenaltyBudget struct {
+	// Points is the maximum number of points that can be lost within the window,
+	// if 0 there is no limit
+	Points int
+
+	// Window is the duration of the sliding window
+	Window time.Duration
+}
+
+func (b *PenaltyBudget) validate() error {
+	if b.Points < 0 {
+		return fmt.Errorf("invalid budget points %v", b.Points)
+	}
+	if b.Points > 0 && b.Window <= 0 {
+		return fmt.Errorf("budget requires a window")
+	}
+	return nil
+}
+
+// Deduction records reputation points lost to a violation
+type Deduction struct {
+	Timestamp time.Time `json:"timestamp"`
+	Points    int       `json:"points"`
+}
+
+// budget returns the penalty budget for objects of type typestr. The budget
+// configured for the type takes precedence over the default budget.
+func (cfg *ServerCfg) budget(typestr string) *PenaltyBudget {
+	if b, ok := cfg.Budget.Types[typestr]; ok {
+		return &b
+	}
+	return &cfg.Budget.PenaltyBudget
+}
+
+// maxDeductions is the most deductions recorded for an object. Once there are more
+// the oldest deductions are merged together.
+const maxDeductions = 32
+
+// deduct limits a decrease of n points to the reputation to the remaining penalty
+// budget for the object, and records the deduction. It returns the number of
+// points the reputation should be decreased by. Deductions outside the budget
+// window are removed.
+//
+// If more than maxDeductions would be recorded, the oldest two are merged into one
+// with the timestamp of the later of the two. The merged points therefore remain
+// in the window for at least as long as they would have otherwise, so merging
+// never increases the remaining budget.
+func (r *Reputation) deduct(n int) int {
+	b := sruntime.cfg.budget(r.Type)
+	if b.Points == 0 {
+		return n
+	}
+	var (
+		now    = time.Now().UTC()
+		keep   []Deduction
+		remain = b.Points
+	)
+	for _, d := range r.Deductions {
+		if now.Sub(d.Timestamp) < b.Window {
+			keep = append(keep, d)
+			remain -= d.Points
+		}
+	}
+	if remain < 0 {
+		remain = 0
+	}
+	if n > remain {
+		n = remain
+	}
+	if n > 0 {
+		keep = append(keep, Deduction{Timestamp: now, Points: n})
+	}
+	for len(keep) > maxDeductions {
+		keep[1].Points += keep[0].Points
+		keep = keep[1:]
+	}
+	r.Deductions = keep
+	return n
+}
@@ -0,0 +1,97 @@
+package iprepd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPenaltyBudgetValidate(t *testing.T) {
+	tests := []struct {
+		Budget PenaltyBudget
+		Valid  bool
+	}{
+		{PenaltyBudget{}, true},
+		{PenaltyBudget{Points: 20, Window: time.Hour}, true},
+		{PenaltyBudget{Points: 20}, false},
+		{PenaltyBudget{Points: -1, Window: time.Hour}, false},
+	}
+	for i, tst := range tests {
+		assert.Equal(t, tst.Valid, tst.Budget.validate() == nil, i)
+	}
+}
+
+func TestPenaltyBudget(t *testing.T) {
+	assert.Nil(t, baseTest())
+	sruntime.cfg.Budget.PenaltyBudget = PenaltyBudget{Points: 12, Window: time.Hour}
+	sruntime.cfg.Budget.Types = map[string]PenaltyBudget{TypeEmail: {}}
+	defer resetTestCfg()
+
+	results, err := applyViolationRequests(TypeIP, "", []ViolationRequest{
+		{Object: "192.168.70.1", Violation: "violation1"},
+		{Object: "192.168.70.1", Violation: "violation1"},
+		{Object: "192.168.70.1", Violation: "violation1"},
+		{Object: "192.168.70.1", Violation: "violation1"},
+		{Object: "192.168.70.2", Violation: "violation1"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, ViolationStatusApplied, results[0].Status)
+	assert.Equal(t, 95, results[0].Reputation.Reputation)
+	assert.Equal(t, ViolationStatusApplied, results[1].Status)
+	assert.Equal(t, 90, results[1].Reputation.Reputation)
+	assert.Equal(t, ViolationStatusOverBudget, results[2].Status)
+	assert.Equal(t, 88, results[2].Reputation.Reputation)
+	assert.Equal(t, ViolationStatusOverBudget, results[3].Status)
+	assert.Equal(t, 88, results[3].Reputation.Reputation)
+	assert.Equal(t, ViolationStatusApplied, results[4].Status)
+	assert.Equal(t, 95, results[4].Reputation.Reputation)
+
+	// Violations over the budget are still recorded
+	hist, err := historyGet(TypeIP, "192.168.70.1")
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(hist))
+	assert.Equal(t, 88, hist[3].Reputation)
+
+	// The budget for email addresses is disabled
+	results, err = applyViolationRequests(TypeEmail, "", []ViolationRequest{
+		{Object: "budget@mozilla.com", Violation: "violation2"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, ViolationStatusApplied, results[0].Status)
+	assert.Equal(t, 50, results[0].Reputation.Reputation)
+
+	// Once deductions are outside the window the budget is available again
+	sruntime.cfg.Budget.PenaltyBudget.Window = time.Millisecond
+	time.Sleep(time.Millisecond * 5)
+	results, err = applyViolationRequests(TypeIP, "", []ViolationRequest{
+		{Object: "192.168.70.1", Violation: "violation1"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, ViolationStatusApplied, results[0].Status)
+	assert.Equal(t, 83, results[0].Reputation.Reputation)
+	assert.Equal(t, 1, len(results[0].Reputation.Deductions))
+}
+
+func TestPenaltyBudgetMaxDeductions(t *testing.T) {
+	sruntime.cfg.Budget.PenaltyBudget = PenaltyBudget{Points: 100, Window: time.Hour}
+	defer resetTestCfg()
+
+	// Deductions beyond the maximum are merged into the oldest, without losing any
+	// points from the budget
+	now := time.Now().UTC()
+	r := Reputation{Object: "192.168.70.3", Type: TypeIP}
+	for i := 0; i < maxDeductions; i++ {
+		r.Deductions = append(r.Deductions,
+			Deduction{Timestamp: now.Add(time.Duration(i-maxDeductions) * time.Second), Points: 1})
+	}
+	assert.Equal(t, 2, r.deduct(2))
+	assert.Equal(t, maxDeductions, len(r.Deductions))
+	assert.Equal(t, Deduction{Timestamp: now.Add(-time.Duration(maxDeductions-1) * time.Second), Points: 2},
+		r.Deductions[0])
+	total := 0
+	for _, d := range r.Deductions {
+		total += d.Points
+	}
+	assert.Equal(t, maxDeductions+2, total)
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 )
 
 // Client is the iprepd service client
@@ -28,6 +29,7 @@ const (
 	clientErrViolationEmpty      = "violation cannot be empty"
 	clientErrReputationNil       = "reputation cannot be nil"
 	clientErrViolationRequestNil = "violation request cannot be nil"
+	clientErrPinRequestNil       = "pin request cannot be nil"
 	clientErrMarshal             = "could not marshal payload"
 	// http client errors
 	clientErrBuildRequest = "could not build http request"
@@ -60,9 +62,23 @@ func (c *Client) addAuth(r *http.Request) {
 	r.Header.Set("Authorization", c.authStr)
 }
 
+// tagQuery returns the query string used to filter results by tags
+func tagQuery(tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	return "?" + url.Values{"tag": tags}.Encode()
+}
+
 // Dump retrieves all reputation entries
 func (c *Client) Dump() ([]Reputation, error) {
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/dump", c.hostURL), nil)
+	return c.DumpTags()
+}
+
+// DumpTags retrieves all reputation entries that have all of the specified tags
+func (c *Client) DumpTags(tags ...string) ([]Reputation, error) {
+	req, err := http.NewRequest(http.MethodGet,
+		fmt.Sprintf("%s/dump%s", c.hostURL, tagQuery(tags)), nil)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %s", clientErrBuildRequest, err)
 	}
@@ -114,6 +130,12 @@ func (c *Client) LBHeartbeat() (bool, error) {
 
 // GetReputation fetches the reputation of a given object and type
 func (c *Client) GetReputation(objectType, object string) (*Reputation, error) {
+	return c.GetReputationTags(objectType, object)
+}
+
+// GetReputationTags fetches the reputation of a given object and type, only
+// returning the reputation if it has all of the specified tags
+func (c *Client) GetReputationTags(objectType, object string, tags ...string) (*Reputation, error) {
 	if object == "" {
 		return nil, errors.New(clientErrObjectEmpty)
 	}
@@ -123,7 +145,8 @@ func (c *Client) GetReputation(objectType, object string) (*Reputation, error) {
 	if err := validateType(objectType, object); err != nil {
 		return nil, errors.New(clientErrBadType)
 	}
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/type/%s/%s", c.hostURL, objectType, object), nil)
+	req, err := http.NewRequest(http.MethodGet,
+		fmt.Sprintf("%s/type/%s/%s%s", c.hostURL, objectType, url.PathEscape(object), tagQuery(tags)), nil)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %s", clientErrBuildRequest, err)
 	}
@@ -147,6 +170,43 @@ func (c *Client) GetReputation(objectType, object string) (*Reputation, error) {
 	return r, nil
 }
 
+// GetHistory fetches the violation history of a given object and type, oldest
+// entry first
+func (c *Client) GetHistory(objectType, object string) ([]HistoryEntry, error) {
+	if object == "" {
+		return nil, errors.New(clientErrObjectEmpty)
+	}
+	if objectType == "" {
+		return nil, errors.New(clientErrObjectTypeEmpty)
+	}
+	if err := validateType(objectType, object); err != nil {
+		return nil, errors.New(clientErrBadType)
+	}
+	req, err := http.NewRequest(http.MethodGet,
+		fmt.Sprintf("%s/type/%s/%s/history", c.hostURL, objectType, url.PathEscape(object)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", clientErrBuildRequest, err)
+	}
+	c.addAuth(req)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", clientErrSendRequest, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %d", clientErrNon200, resp.StatusCode)
+	}
+	byt, err := ioutil.ReadAll(resp.Body)
+	defer resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", clientErrReadResponse, err)
+	}
+	var h []HistoryEntry
+	if err := json.Unmarshal(byt, &h); err != nil {
+		return nil, fmt.Errorf("%s: %s", clientErrUnmarshal, err)
+	}
+	return h, nil
+}
+
 // SetReputation updates the reputation of a given object and type to a given score
 func (c *Client) SetReputation(r *Reputation) error {
 	if r == nil {
@@ -166,7 +226,7 @@ func (c *Client) SetReputation(r *Reputation) error {
 		return fmt.Errorf("%s: %s", clientErrMarshal, err)
 	}
 	req, err := http.NewRequest(http.MethodPut,
-		fmt.Sprintf("%s/type/%s/%s", c.hostURL, r.Type, r.Object), bytes.NewBuffer(byt))
+		fmt.Sprintf("%s/type/%s/%s", c.hostURL, r.Type, url.PathEscape(r.Object)), bytes.NewBuffer(byt))
 	if err != nil {
 		return fmt.Errorf("%s: %s", clientErrMarshal, err)
 	}
@@ -192,7 +252,77 @@ func (c *Client) DeleteReputation(objectType, object string) error {
 	if err := validateType(objectType, object); err != nil {
 		return errors.New(clientErrBadType)
 	}
-	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/type/%s/%s", c.hostURL, objectType, object), nil)
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/type/%s/%s", c.hostURL, objectType, url.PathEscape(object)), nil)
+	if err != nil {
+		return fmt.Errorf("%s: %s", clientErrBuildRequest, err)
+	}
+	c.addAuth(req)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %s", clientErrSendRequest, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %d", clientErrNon200, resp.StatusCode)
+	}
+	return nil
+}
+
+// PinReputation pins the reputation of a given object and type to the score in
+// the pin request, returning the resulting reputation
+func (c *Client) PinReputation(objectType, object string, p *PinRequest) (*Reputation, error) {
+	if p == nil {
+		return nil, errors.New(clientErrPinRequestNil)
+	}
+	if object == "" {
+		return nil, errors.New(clientErrObjectEmpty)
+	}
+	if objectType == "" {
+		return nil, errors.New(clientErrObjectTypeEmpty)
+	}
+	if err := validateType(objectType, object); err != nil {
+		return nil, errors.New(clientErrBadType)
+	}
+	byt, err := json.Marshal(p)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", clientErrMarshal, err)
+	}
+	req, err := http.NewRequest(http.MethodPut,
+		fmt.Sprintf("%s/type/%s/%s/pin", c.hostURL, objectType, url.PathEscape(object)), bytes.NewBuffer(byt))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", clientErrBuildRequest, err)
+	}
+	c.addAuth(req)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", clientErrSendRequest, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %d", clientErrNon200, resp.StatusCode)
+	}
+	byt, err = ioutil.ReadAll(resp.Body)
+	defer resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", clientErrReadResponse, err)
+	}
+	var r *Reputation
+	if err := json.Unmarshal(byt, &r); err != nil {
+		return nil, fmt.Errorf("%s: %s", clientErrUnmarshal, err)
+	}
+	return r, nil
+}
+
+// UnpinReputation removes the pin from the reputation of a given object and type
+func (c *Client) UnpinReputation(objectType, object string) error {
+	if object == "" {
+		return errors.New(clientErrObjectEmpty)
+	}
+	if objectType == "" {
+		return errors.New(clientErrObjectTypeEmpty)
+	}
+	if err := validateType(objectType, object); err != nil {
+		return errors.New(clientErrBadType)
+	}
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/type/%s/%s/pin", c.hostURL, objectType, url.PathEscape(object)), nil)
 	if err != nil {
 		return fmt.Errorf("%s: %s", clientErrBuildRequest, err)
 	}
@@ -265,6 +395,37 @@ func (c *Client) GetViolations() ([]Violation, error) {
 	return v, nil
 }
 
+// GetTypeViolations gets the violations that apply to objects of a given type,
+// including type specific violations
+func (c *Client) GetTypeViolations(objectType string) ([]Violation, error) {
+	if objectType == "" {
+		return nil, errors.New(clientErrObjectTypeEmpty)
+	}
+	req, err := http.NewRequest(http.MethodGet,
+		fmt.Sprintf("%s/violations?type=%s", c.hostURL, url.QueryEscape(objectType)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", clientErrBuildRequest, err)
+	}
+	c.addAuth(req)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", clientErrSendRequest, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %d", clientErrNon200, resp.StatusCode)
+	}
+	bodyByt, err := ioutil.ReadAll(resp.Body)
+	defer resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", clientErrReadResponse, err)
+	}
+	var v []Violation
+	if err = json.Unmarshal(bodyByt, &v); err != nil {
+		return nil, fmt.Errorf("%s: %s", clientErrUnmarshal, err)
+	}
+	return v, nil
+}
+
 // ApplyViolation submits a ViolationRequest to iprepd
 func (c *Client) ApplyViolation(vr *ViolationRequest) error {
 	if vr == nil {
@@ -287,7 +448,7 @@ func (c *Client) ApplyViolation(vr *ViolationRequest) error {
 		return fmt.Errorf("%s: %s", clientErrMarshal, err)
 	}
 	req, err := http.NewRequest(http.MethodPut,
-		fmt.Sprintf("%s/violations/type/%s/%s", c.hostURL, vr.Type, vr.Object), bytes.NewBuffer(byt))
+		fmt.Sprintf("%s/violations/type/%s/%s", c.hostURL, vr.Type, url.PathEscape(vr.Object)), bytes.NewBuffer(byt))
 	if err != nil {
 		return fmt.Errorf("%s: %s", clientErrBuildRequest, err)
 	}
@@ -302,8 +463,34 @@ func (c *Client) ApplyViolation(vr *ViolationRequest) error {
 	return nil
 }
 
-// BatchApplyViolation submits a batch of ViolationRequests to iprepd
+// BatchApplyViolation submits a batch of ViolationRequests to iprepd. Only the
+// status of the response is checked, so this works with servers that do not
+// return per-item results. Use BatchApplyViolationResults to determine the
+// outcome of each request.
 func (c *Client) BatchApplyViolation(typ string, vrs []ViolationRequest) error {
+	return c.putViolations(fmt.Sprintf("%s/violations/type/%s", c.hostURL, typ), typ, vrs, nil)
+}
+
+// BatchApplyViolationResults submits a batch of ViolationRequests to iprepd. The
+// result for each request is returned in the same order as the requests, and can
+// be used to identify requests which failed and should be retried.
+func (c *Client) BatchApplyViolationResults(typ string, vrs []ViolationRequest) (ret []ViolationResult, err error) {
+	err = c.putViolations(fmt.Sprintf("%s/violations/type/%s", c.hostURL, typ), typ, vrs, &ret)
+	return
+}
+
+// SimulateViolations returns the results a batch of ViolationRequests would have
+// if they were applied, without changing any reputations. This can be used to
+// test penalties and new detectors before they are used to apply violations.
+func (c *Client) SimulateViolations(typ string, vrs []ViolationRequest) (ret []ViolationResult, err error) {
+	err = c.putViolations(fmt.Sprintf("%s/simulate/violations/type/%s", c.hostURL, typ), typ, vrs, &ret)
+	return
+}
+
+// putViolations submits a batch of ViolationRequests to endpoint. If results is not
+// nil, the per-item results in the response body are decoded into it, otherwise
+// only the status of the response is checked.
+func (c *Client) putViolations(endpoint string, typ string, vrs []ViolationRequest, results *[]ViolationResult) error {
 	if typ == "" {
 		return errors.New(clientErrObjectTypeEmpty)
 	}
@@ -314,8 +501,7 @@ func (c *Client) BatchApplyViolation(typ string, vrs []ViolationRequest) error {
 	if err != nil {
 		return fmt.Errorf("%s: %s", clientErrMarshal, err)
 	}
-	req, err := http.NewRequest(http.MethodPut,
-		fmt.Sprintf("%s/violations/type/%s", c.hostURL, typ), bytes.NewBuffer(byt))
+	req, err := http.NewRequest(http.MethodPut, endpoint, bytes.NewBuffer(byt))
 	if err != nil {
 		return fmt.Errorf("%s: %s", clientErrMarshal, err)
 	}
@@ -324,8 +510,19 @@ func (c *Client) BatchApplyViolation(typ string, vrs []ViolationRequest) error {
 	if err != nil {
 		return fmt.Errorf("%s: %s", clientErrSendRequest, err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("%s: %d", clientErrNon200, resp.StatusCode)
 	}
+	if results == nil {
+		return nil
+	}
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s: %s", clientErrReadResponse, err)
+	}
+	if err = json.Unmarshal(bodyBytes, results); err != nil {
+		return fmt.Errorf("%s: %s", clientErrUnmarshal, err)
+	}
 	return nil
 }
@@ -451,6 +451,31 @@ func TestGetViolations(t *testing.T) {
 	assert.Equal(t, fmt.Errorf("%s: %d", clientErrNon200, http.StatusUnauthorized), err)
 }
 
+func TestGetTypeViolations(t *testing.T) {
+	srv := getTestServer(t)
+	defer srv.Close()
+	defer func() { sruntime.cfg.TypeViolations = nil }()
+	sruntime.cfg.TypeViolations = map[string][]Violation{
+		TypeEmail: {{Name: "violation1", Penalty: 20, DecreaseLimit: 0}},
+	}
+
+	c, err := getTestClientAuthorized(srv)
+	assert.Nil(t, err)
+	vs, err := c.GetTypeViolations(TypeEmail)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(vs))
+	assert.Equal(t, Violation{Name: "violation1", Penalty: 20, DecreaseLimit: 0}, vs[0])
+	vs, err = c.GetTypeViolations(TypeIP)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(vs))
+	assert.Equal(t, Violation{Name: "violation1", Penalty: 5, DecreaseLimit: 25}, vs[0])
+
+	_, err = c.GetTypeViolations("")
+	assert.Equal(t, errors.New(clientErrObjectTypeEmpty), err)
+	_, err = c.GetTypeViolations("invalid")
+	assert.Equal(t, fmt.Errorf("%s: %d", clientErrNon200, http.StatusBadRequest), err)
+}
+
 func TestApplyViolation(t *testing.T) {
 	srv := getTestServer(t)
 	defer srv.Close()
@@ -650,23 +675,6 @@ func TestBatchApplyViolations(t *testing.T) {
 			C:           goodClient,
 		},
 		// server error propagation
-		{
-			Name: "test: Malformed IP in Violation Request",
-			Type: TypeIP,
-			VRS: []ViolationRequest{
-				{
-					Object:    "asd8.28.26",
-					Violation: "violation1",
-				},
-				{
-					Object:    "208.28.28.26",
-					Violation: "violation1",
-				},
-			},
-			ExpectErr:   true,
-			ExpectedErr: fmt.Errorf("%s: %d", clientErrNon200, http.StatusBadRequest),
-			C:           goodClient,
-		},
 		{
 			Name: "test: Unauthorized",
 			Type: TypeIP,
@@ -690,5 +698,243 @@ func TestBatchApplyViolations(t *testing.T) {
 		} else {
 			assert.Nil(t, err, tst.Name)
 		}
+
+		results, err := tst.C.BatchApplyViolationResults(tst.Type, tst.VRS)
+		if tst.ExpectErr {
+			assert.Equal(t, tst.ExpectedErr, err, tst.Name)
+		} else {
+			assert.Nil(t, err, tst.Name)
+			assert.Equal(t, len(tst.VRS), len(results), tst.Name)
+			for _, r := range results {
+				assert.Equal(t, ViolationStatusApplied, r.Status, tst.Name)
+			}
+		}
 	}
+
+	// per-item results
+	results, err := goodClient.BatchApplyViolationResults(TypeIP, []ViolationRequest{
+		{
+			Object:    "asd8.28.26",
+			Violation: "violation1",
+		},
+		{
+			Object:    "208.28.28.30",
+			Violation: "violation1",
+		},
+		{
+			Object:    "208.28.28.31",
+			Violation: "unknown",
+		},
+		{
+			Object:    "10.0.0.2",
+			Violation: "violation1",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(results))
+	assert.Equal(t, ViolationStatusInvalidObject, results[0].Status)
+	assert.Equal(t, "invalid ip format asd8.28.26", results[0].Error)
+	assert.Nil(t, results[0].Reputation)
+	assert.Equal(t, ViolationStatusApplied, results[1].Status)
+	assert.Equal(t, "208.28.28.30", results[1].Object)
+	assert.Equal(t, 95, results[1].Reputation.Reputation)
+	assert.Equal(t, ViolationStatusUnknownViolation, results[2].Status)
+	assert.Nil(t, results[2].Reputation)
+	assert.Equal(t, ViolationStatusExcepted, results[3].Status)
+	assert.Equal(t, 95, results[3].Reputation.Reputation)
+
+	// Servers that predate per-item results return an empty body, which should
+	// not be an error for BatchApplyViolation
+	legacy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer legacy.Close()
+	legacyClient, err := getTestClientAuthorized(legacy)
+	assert.Nil(t, err)
+	vrs := []ViolationRequest{{Object: "208.28.28.30", Violation: "violation1"}}
+	assert.Nil(t, legacyClient.BatchApplyViolation(TypeIP, vrs))
+	_, err = legacyClient.BatchApplyViolationResults(TypeIP, vrs)
+	assert.NotNil(t, err)
+}
+
+func TestGetHistory(t *testing.T) {
+	srv := getTestServer(t)
+	defer srv.Close()
+
+	goodClient, err := getTestClientAuthorized(srv)
+	assert.Nil(t, err)
+	badClient, err := getTestClientUnauthorized(srv)
+	assert.Nil(t, err)
+
+	err = goodClient.ApplyViolation(&ViolationRequest{
+		Object:    "192.168.0.1",
+		Type:      TypeIP,
+		Violation: "violation1",
+		Reason:    "testing",
+	})
+	assert.Nil(t, err)
+
+	h, err := goodClient.GetHistory(TypeIP, "192.168.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(h))
+	assert.Equal(t, "violation1", h[0].Violation)
+	assert.Equal(t, 50, h[0].OriginalReputation)
+	assert.Equal(t, 45, h[0].Reputation)
+	assert.Equal(t, "u1", h[0].Principal)
+	assert.Equal(t, "testing", h[0].Reason)
+
+	_, err = goodClient.GetHistory("", "192.168.0.1")
+	assert.Equal(t, errors.New(clientErrObjectTypeEmpty), err)
+	_, err = goodClient.GetHistory(TypeIP, "")
+	assert.Equal(t, errors.New(clientErrObjectEmpty), err)
+	_, err = goodClient.GetHistory(TypeIP, "usr@mozilla.com")
+	assert.Equal(t, errors.New(clientErrBadType), err)
+	_, err = badClient.GetHistory(TypeIP, "192.168.0.1")
+	assert.Equal(t, fmt.Errorf("%s: %d", clientErrNon200, http.StatusUnauthorized), err)
+}
+
+func TestTags(t *testing.T) {
+	srv := getTestServer(t)
+	defer srv.Close()
+
+	c, err := getTestClientAuthorized(srv)
+	assert.Nil(t, err)
+	err = c.ApplyViolation(&ViolationRequest{
+		Object:    "192.168.0.1",
+		Type:      TypeIP,
+		Violation: "violation1",
+		Tags:      []string{"fxa", "campaign 1"},
+	})
+	assert.Nil(t, err)
+
+	r, err := c.GetReputationTags(TypeIP, "192.168.0.1", "campaign 1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"fxa", "campaign 1"}, r.Tags)
+	_, err = c.GetReputationTags(TypeIP, "192.168.0.1", "fxa", "other")
+	assert.Equal(t, fmt.Errorf("%s: %d", clientErrNon200, http.StatusNotFound), err)
+
+	reps, err := c.DumpTags("fxa")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(reps))
+	assert.Equal(t, "192.168.0.1", reps[0].Object)
+	reps, err = c.DumpTags("other")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(reps))
+}
+
+func TestPinReputation(t *testing.T) {
+	srv := getTestServer(t)
+	defer srv.Close()
+
+	goodClient, err := getTestClientAuthorized(srv)
+	assert.Nil(t, err)
+	badClient, err := getTestClientUnauthorized(srv)
+	assert.Nil(t, err)
+
+	r, err := goodClient.PinReputation(TypeIP, "192.168.0.1", &PinRequest{Reputation: 0, Reason: "testing"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, r.Reputation)
+	assert.True(t, r.Pinned)
+	assert.Equal(t, "testing", r.PinReason)
+
+	err = goodClient.ApplyViolation(&ViolationRequest{
+		Object:    "192.168.0.1",
+		Type:      TypeIP,
+		Violation: "violation2",
+	})
+	assert.Nil(t, err)
+	r, err = goodClient.GetReputation(TypeIP, "192.168.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, r.Reputation)
+
+	assert.Nil(t, goodClient.UnpinReputation(TypeIP, "192.168.0.1"))
+	r, err = goodClient.GetReputation(TypeIP, "192.168.0.1")
+	assert.Nil(t, err)
+	assert.False(t, r.Pinned)
+
+	_, err = goodClient.PinReputation(TypeIP, "192.168.0.1", nil)
+	assert.Equal(t, errors.New(clientErrPinRequestNil), err)
+	_, err = goodClient.PinReputation(TypeIP, "usr@mozilla.com", &PinRequest{})
+	assert.Equal(t, errors.New(clientErrBadType), err)
+	_, err = goodClient.PinReputation(TypeIP, "192.168.0.1", &PinRequest{Reputation: 200})
+	assert.Equal(t, fmt.Errorf("%s: %d", clientErrNon200, http.StatusBadRequest), err)
+	_, err = badClient.PinReputation(TypeIP, "192.168.0.1", &PinRequest{})
+	assert.Equal(t, fmt.Errorf("%s: %d", clientErrNon200, http.StatusUnauthorized), err)
+	err = goodClient.UnpinReputation(TypeIP, "192.168.5.5")
+	assert.Equal(t, fmt.Errorf("%s: %d", clientErrNon200, http.StatusNotFound), err)
+	err = goodClient.UnpinReputation("", "192.168.0.1")
+	assert.Equal(t, errors.New(clientErrObjectTypeEmpty), err)
+}
+
+func TestGetReputationBand(t *testing.T) {
+	srv := getTestServer(t)
+	defer srv.Close()
+
+	c, err := getTestClientAuthorized(srv)
+	assert.Nil(t, err)
+
+	r, err := c.GetReputation(TypeIP, "192.168.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, "", r.Band)
+	assert.Equal(t, "", r.Action)
+
+	sruntime.cfg.Bands.Default = []Band{
+		{Name: "block", Min: 0, Max: 49, Action: "block"},
+		{Name: "challenge", Min: 50, Max: 79, Action: "captcha"},
+	}
+	defer func() {
+		sruntime.cfg.Bands.Default = nil
+	}()
+	r, err = c.GetReputation(TypeIP, "192.168.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, 50, r.Reputation)
+	assert.Equal(t, "challenge", r.Band)
+	assert.Equal(t, "captcha", r.Action)
+}
+
+func TestClientSimulateViolations(t *testing.T) {
+	srv := getTestServer(t)
+	defer srv.Close()
+
+	c, err := getTestClientAuthorized(srv)
+	assert.Nil(t, err)
+
+	results, err := c.SimulateViolations(TypeIP, []ViolationRequest{
+		{Object: "192.168.0.1", Type: TypeIP, Violation: "violation1"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, ViolationStatusApplied, results[0].Status)
+	assert.Equal(t, 45, results[0].Reputation.Reputation)
+
+	r, err := c.GetReputation(TypeIP, "192.168.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, 50, r.Reputation)
+
+	_, err = c.SimulateViolations("", []ViolationRequest{{Object: "192.168.0.1"}})
+	assert.Equal(t, errors.New(clientErrObjectTypeEmpty), err)
+}
+
+func TestCustomTypeClient(t *testing.T) {
+	srv := getTestServer(t)
+	defer srv.Close()
+
+	c, err := getTestClientAuthorized(srv)
+	assert.Nil(t, err)
+
+	unregisterTypes(t, "network")
+	assert.Nil(t, RegisterType("network", TypeConfig{Validator: "cidr"}))
+	err = c.ApplyViolation(&ViolationRequest{
+		Object:    "10.0.0.0/8",
+		Type:      "network",
+		Violation: "violation1",
+	})
+	assert.Nil(t, err)
+	r, err := c.GetReputation("network", "10.0.0.0/8")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.0/8", r.Object)
+	assert.Equal(t, 95, r.Reputation)
+
+	_, err = c.GetReputation("network", "10.0.0.1")
+	assert.Equal(t, errors.New(clientErrBadType), err)
 }
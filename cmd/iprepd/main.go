@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -40,11 +42,7 @@ func main() {
 						return err
 					}
 					iprepd.CreateServerRuntime(c.String("config"))
-					reputation, err := iprepd.RepDump()
-					if err != nil {
-						return err
-					}
-					return IPBlocklistGCS(config, reputation)
+					return IPBlocklistGCS(config)
 				},
 			},
 		},
@@ -56,31 +54,53 @@ func main() {
 	}
 }
 
-func IPBlocklistGCS(config iprepd.ServerCfg, reputationDump []iprepd.Reputation) error {
+// errLimitReached is used to stop iterating over reputation entries once the
+// configured maximum number of blocklist entries has been written
+var errLimitReached = errors.New("blocklist limit reached")
+
+func IPBlocklistGCS(config iprepd.ServerCfg) error {
 	var (
-		blocklistFile       = "./ip-blocklist"
-		ipBlocklistContents string
-		cnt                 int
+		blocklistFile = "./ip-blocklist"
+		cnt           int
 	)
 
-	for _, rep := range reputationDump {
+	fd, err := os.Create(blocklistFile)
+	if err != nil {
+		return err
+	}
+	wr := bufio.NewWriter(fd)
+
+	// Write entries to the blocklist file as they are read from the store, rather
+	// than loading the entire dataset into memory
+	err = iprepd.RepDumpFunc(func(rep iprepd.Reputation) error {
 		if rep.Type != "ip" {
-			continue
+			return nil
 		}
 		if config.Sync.MinimumReputation < rep.Reputation {
-			continue
+			return nil
 		}
 
-		ipBlocklistContents = ipBlocklistContents + fmt.Sprintf("%s/32\n", rep.Object)
+		_, err := fmt.Fprintf(wr, "%s/32\n", rep.Object)
+		if err != nil {
+			return err
+		}
 
 		cnt++
 		if cnt == config.Sync.MaxLimit {
-			break
+			return errLimitReached
 		}
-
+		return nil
+	})
+	if err != nil && err != errLimitReached {
+		fd.Close()
+		return err
 	}
-
-	err := os.WriteFile(blocklistFile, []byte(ipBlocklistContents), 0644)
+	err = wr.Flush()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	err = fd.Close()
 	if err != nil {
 		return err
 	}
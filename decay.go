@@ -0,0 +1,182 @@
+package iprepd
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// DecayLinear recovers a fixed number of points every interval
+	DecayLinear = "linear"
+
+	// DecayExponential halves the difference between the reputation and 100
+	// every half life
+	DecayExponential = "exponential"
+
+	// DecayStepped raises the reputation to fixed values once set periods of time
+	// have passed
+	DecayStepped = "stepped"
+)
+
+// DecayConfig describes how a reputation recovers back to 100 over time
+type DecayConfig struct {
+	// Strategy is the name of the decay strategy, and defaults to DecayLinear
+	Strategy string
+
+	// Points and Interval configure linear decay, with Points being added to the
+	// reputation every Interval
+	Points   int
+	Interval time.Duration
+
+	// HalfLife configures exponential decay
+	HalfLife time.Duration
+
+	// Steps configures stepped decay
+	Steps []DecayStep
+}
+
+// DecayStep raises a reputation to at least Reputation once After has passed
+type DecayStep struct {
+	After      time.Duration
+	Reputation int
+}
+
+// decayStrategy implements recovery of a reputation over time
+type decayStrategy interface {
+	// recovered returns the number of points a reputation of rep recovers after
+	// duration d
+	recovered(rep int, d time.Duration) int
+
+	// recoveryTime returns how long it takes a reputation of rep to recover to
+	// 100, or false if it never recovers
+	recoveryTime(rep int) (time.Duration, bool)
+}
+
+func (d *DecayConfig) validate() error {
+	switch d.Strategy {
+	case "":
+		d.Strategy = DecayLinear
+	case DecayLinear:
+	case DecayExponential:
+		if d.HalfLife <= 0 {
+			return fmt.Errorf("exponential decay requires a half life")
+		}
+	case DecayStepped:
+		if len(d.Steps) == 0 {
+			return fmt.Errorf("stepped decay requires steps")
+		}
+		for _, s := range d.Steps {
+			if s.After < 0 || s.Reputation < 0 || s.Reputation > 100 {
+				return fmt.Errorf("invalid decay step")
+			}
+		}
+	default:
+		return fmt.Errorf("invalid decay strategy %v", d.Strategy)
+	}
+	return nil
+}
+
+// strategy returns the decay strategy implementation for the configuration
+func (d *DecayConfig) strategy() decayStrategy {
+	switch d.Strategy {
+	case DecayExponential:
+		return exponentialDecay{halfLife: d.HalfLife}
+	case DecayStepped:
+		return steppedDecay{steps: d.Steps}
+	}
+	return linearDecay{points: d.Points, interval: d.Interval}
+}
+
+// decayFor returns the decay configuration that applies to reputation r. This is
+// the strategy selected by the last violation applied to the entry, or if none
+// was selected the strategy configured for the object type, otherwise the
+// default decay configuration.
+func (cfg *ServerCfg) decayFor(r *Reputation) *DecayConfig {
+	if r.Decay != "" {
+		if d, ok := cfg.Decay.Strategies[r.Decay]; ok {
+			return &d
+		}
+	}
+	if n, ok := cfg.Decay.Types[r.Type]; ok {
+		if d, ok := cfg.Decay.Strategies[n]; ok {
+			return &d
+		}
+	}
+	return &cfg.Decay.DecayConfig
+}
+
+type linearDecay struct {
+	points   int
+	interval time.Duration
+}
+
+func (l linearDecay) recovered(rep int, d time.Duration) int {
+	if l.points <= 0 || l.interval <= 0 {
+		return 0
+	}
+	return l.points * int(d/l.interval)
+}
+
+func (l linearDecay) recoveryTime(rep int) (time.Duration, bool) {
+	if rep >= 100 {
+		return 0, true
+	}
+	if l.points <= 0 || l.interval <= 0 {
+		return 0, false
+	}
+	steps := (100 - rep + l.points - 1) / l.points
+	return l.interval * time.Duration(steps), true
+}
+
+type exponentialDecay struct {
+	halfLife time.Duration
+}
+
+func (e exponentialDecay) recovered(rep int, d time.Duration) int {
+	// Round the remaining deficit half down, so the reputation reaches 100 at the
+	// time returned by recoveryTime
+	deficit := float64(100 - rep)
+	remain := math.Ceil(deficit*math.Pow(0.5, float64(d)/float64(e.halfLife)) - 0.5)
+	return int(deficit - remain)
+}
+
+func (e exponentialDecay) recoveryTime(rep int) (time.Duration, bool) {
+	if rep >= 100 {
+		return 0, true
+	}
+	// The reputation reaches 100 once the remaining deficit is halved to 0.5
+	n := math.Log2(float64(100-rep) * 2)
+	return time.Duration(math.Ceil(n * float64(e.halfLife))), true
+}
+
+type steppedDecay struct {
+	steps []DecayStep
+}
+
+func (s steppedDecay) recovered(rep int, d time.Duration) int {
+	ret := 0
+	for _, x := range s.steps {
+		if d >= x.After && x.Reputation-rep > ret {
+			ret = x.Reputation - rep
+		}
+	}
+	return ret
+}
+
+func (s steppedDecay) recoveryTime(rep int) (time.Duration, bool) {
+	if rep >= 100 {
+		return 0, true
+	}
+	var (
+		ret   time.Duration
+		found bool
+	)
+	for _, x := range s.steps {
+		if x.Reputation >= 100 && (!found || x.After < ret) {
+			ret = x.After
+			found = true
+		}
+	}
+	return ret, found
+}
@@ -0,0 +1,160 @@
+package iprepd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecayStrategies(t *testing.T) {
+	tests := []struct {
+		Name      string
+		Decay     DecayConfig
+		Rep       int
+		Elapsed   time.Duration
+		Recovered int
+	}{
+		{"linear", DecayConfig{Points: 1, Interval: time.Minute}, 50, time.Minute * 10, 10},
+		{"linear partial", DecayConfig{Points: 5, Interval: time.Minute}, 50, time.Second * 90, 5},
+		{"linear disabled", DecayConfig{Points: 0, Interval: time.Minute}, 50, time.Hour, 0},
+		{"exponential", DecayConfig{Strategy: DecayExponential, HalfLife: time.Hour}, 20, time.Hour, 40},
+		{"exponential twice", DecayConfig{Strategy: DecayExponential, HalfLife: time.Hour}, 20, time.Hour * 2, 60},
+		{"exponential none", DecayConfig{Strategy: DecayExponential, HalfLife: time.Hour}, 20, 0, 0},
+		{"exponential full", DecayConfig{Strategy: DecayExponential, HalfLife: time.Hour}, 20, time.Hour * 10, 80},
+		{
+			"stepped before", DecayConfig{Strategy: DecayStepped, Steps: []DecayStep{
+				{time.Hour, 50}, {time.Hour * 24, 100},
+			}}, 10, time.Minute, 0,
+		},
+		{
+			"stepped first", DecayConfig{Strategy: DecayStepped, Steps: []DecayStep{
+				{time.Hour, 50}, {time.Hour * 24, 100},
+			}}, 10, time.Hour * 2, 40,
+		},
+		{
+			"stepped above step", DecayConfig{Strategy: DecayStepped, Steps: []DecayStep{
+				{time.Hour, 50}, {time.Hour * 24, 100},
+			}}, 60, time.Hour * 2, 0,
+		},
+		{
+			"stepped last", DecayConfig{Strategy: DecayStepped, Steps: []DecayStep{
+				{time.Hour, 50}, {time.Hour * 24, 100},
+			}}, 10, time.Hour * 25, 90,
+		},
+	}
+	for _, tst := range tests {
+		assert.Nil(t, tst.Decay.validate(), tst.Name)
+		assert.Equal(t, tst.Recovered, tst.Decay.strategy().recovered(tst.Rep, tst.Elapsed), tst.Name)
+	}
+}
+
+func TestDecayRecoveryTime(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Decay    DecayConfig
+		Rep      int
+		Duration time.Duration
+		OK       bool
+	}{
+		{"linear", DecayConfig{Points: 2, Interval: time.Minute}, 45, time.Minute * 28, true},
+		{"linear disabled", DecayConfig{Points: 0, Interval: time.Minute}, 45, 0, false},
+		{"linear recovered", DecayConfig{Points: 0, Interval: time.Minute}, 100, 0, true},
+		{"exponential", DecayConfig{Strategy: DecayExponential, HalfLife: time.Hour}, 68, time.Hour * 6, true},
+		{
+			"stepped", DecayConfig{Strategy: DecayStepped, Steps: []DecayStep{
+				{time.Hour, 50}, {time.Hour * 24, 100},
+			}}, 10, time.Hour * 24, true,
+		},
+		{
+			"stepped never", DecayConfig{Strategy: DecayStepped, Steps: []DecayStep{
+				{time.Hour, 50},
+			}}, 10, 0, false,
+		},
+	}
+	for _, tst := range tests {
+		d, ok := tst.Decay.strategy().recoveryTime(tst.Rep)
+		assert.Equal(t, tst.OK, ok, tst.Name)
+		assert.Equal(t, tst.Duration, d, tst.Name)
+		if ok {
+			// The reputation should have fully recovered after the recovery time
+			x := tst.Decay.strategy().recovered(tst.Rep, d)
+			assert.True(t, tst.Rep+x >= 100, tst.Name)
+		}
+	}
+}
+
+func TestDecayConfigValidate(t *testing.T) {
+	d := DecayConfig{}
+	assert.Nil(t, d.validate())
+	assert.Equal(t, DecayLinear, d.Strategy)
+	d = DecayConfig{Strategy: DecayExponential}
+	assert.NotNil(t, d.validate())
+	d = DecayConfig{Strategy: DecayStepped}
+	assert.NotNil(t, d.validate())
+	d = DecayConfig{Strategy: DecayStepped, Steps: []DecayStep{{time.Hour, 101}}}
+	assert.NotNil(t, d.validate())
+	d = DecayConfig{Strategy: "invalid"}
+	assert.NotNil(t, d.validate())
+}
+
+func TestDecaySelection(t *testing.T) {
+	assert.Nil(t, baseTest())
+	origDecay := sruntime.cfg.Decay
+	origViolations := sruntime.cfg.Violations
+	defer func() {
+		sruntime.cfg.Decay = origDecay
+		sruntime.cfg.Violations = origViolations
+	}()
+	sruntime.cfg.Decay.Strategies = map[string]DecayConfig{
+		"slow":  {Strategy: DecayExponential, HalfLife: time.Hour * 24},
+		"quick": {Strategy: DecayLinear, Points: 10, Interval: time.Minute},
+	}
+	sruntime.cfg.Decay.Types = map[string]string{TypeEmail: "quick"}
+	sruntime.cfg.Violations = append([]Violation{
+		{Name: "serious", Penalty: 80, Decay: "slow"},
+	}, origViolations...)
+
+	// The type strategy applies if no violation selected a strategy
+	r := Reputation{Object: "usr@mozilla.com", Type: TypeEmail, Reputation: 50,
+		LastUpdated: time.Now().Add(-time.Minute * 2)}
+	assert.Nil(t, r.applyDecay())
+	assert.Equal(t, 70, r.Reputation)
+
+	// Otherwise the default strategy, which is disabled in the tests
+	r = Reputation{Object: "192.168.40.1", Type: TypeIP, Reputation: 50,
+		LastUpdated: time.Now().Add(-time.Minute * 2)}
+	assert.Nil(t, r.applyDecay())
+	assert.Equal(t, 50, r.Reputation)
+
+	// A violation strategy takes precedence over the type strategy
+	res, err := applyViolationRequests(TypeEmail, "", []ViolationRequest{
+		{Object: "usr2@mozilla.com", Type: TypeEmail, Violation: "serious"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "slow", res[0].Reputation.Decay)
+	r = *res[0].Reputation
+	r.LastUpdated = time.Now().Add(-time.Hour * 24)
+	assert.Nil(t, r.applyDecay())
+	assert.Equal(t, 60, r.Reputation)
+	assert.Equal(t, "slow", r.Decay)
+
+	// The selected strategy is cleared once the reputation recovers
+	r.LastUpdated = time.Now().Add(-time.Hour * 24 * 30)
+	assert.Nil(t, r.applyDecay())
+	assert.Equal(t, 100, r.Reputation)
+	assert.Equal(t, "", r.Decay)
+
+	// A reviewed entry keeps its reviewed flag if it decays to exactly 100, and
+	// only has it cleared if recovery would take it above 100
+	r = Reputation{Object: "usr3@mozilla.com", Type: TypeEmail, Reputation: 50,
+		Reviewed: true, LastUpdated: time.Now().Add(-time.Minute * 5)}
+	assert.Nil(t, r.applyDecay())
+	assert.Equal(t, 100, r.Reputation)
+	assert.True(t, r.Reviewed)
+	r.Reputation = 50
+	r.LastUpdated = time.Now().Add(-time.Minute * 6)
+	assert.Nil(t, r.applyDecay())
+	assert.Equal(t, 100, r.Reputation)
+	assert.False(t, r.Reviewed)
+}
@@ -0,0 +1,113 @@
+package iprepd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultDomainExclude lists common free and shared email providers, which are
+// excluded from domain reputation unless the exclusions are configured. A handful
+// of bad addresses at a shared provider says nothing about its other users, so an
+// aggregate reputation for the provider would only penalize unrelated addresses.
+var defaultDomainExclude = []string{
+	"163.com",
+	"aol.com",
+	"gmail.com",
+	"gmx.com",
+	"gmx.de",
+	"googlemail.com",
+	"hotmail.com",
+	"icloud.com",
+	"live.com",
+	"mail.com",
+	"mail.ru",
+	"me.com",
+	"msn.com",
+	"outlook.com",
+	"proton.me",
+	"protonmail.com",
+	"qq.com",
+	"yahoo.com",
+	"yandex.ru",
+}
+
+// domainExcluded returns true if domain is excluded from domain reputation
+func domainExcluded(domain string) bool {
+	return sruntime.cfg.Domain.excluded[domain]
+}
+
+// domainKey returns the key the aggregate reputation for the domain of email
+// address email is stored under, along with the domain
+func domainKey(email string) (key string, domain string, err error) {
+	i := strings.LastIndex(email, "@")
+	if i == -1 || i == len(email)-1 {
+		return "", "", fmt.Errorf("cannot determine domain for invalid email address")
+	}
+	domain = strings.ToLower(email[i+1:])
+	return auxKeyMarker + "domain " + TypeEmail + " " + domain, domain, nil
+}
+
+// domainUpdate updates the aggregate reputation for the domains of the email
+// addresses in reps. Entries in reps with a nil value remove the address from the
+// domain. Addresses at excluded domains are not added.
+func domainUpdate(reps map[string]*Reputation) error {
+	if !sruntime.cfg.Domain.Enable {
+		return nil
+	}
+	include := make(map[string]*Reputation, len(reps))
+	for obj, r := range reps {
+		if _, domain, err := domainKey(obj); r != nil && err == nil && domainExcluded(domain) {
+			continue
+		}
+		include[obj] = r
+	}
+	return aggregateUpdate(include, func(obj string) (string, error) {
+		k, _, err := domainKey(obj)
+		return k, err
+	}, sruntime.cfg.Domain.MaxAddresses)
+}
+
+// domainRecord records the results of violations applied to email addresses in
+// the aggregate reputation for their domains
+func domainRecord(applied []appliedViolation) error {
+	return domainUpdate(aggregateRecord(applied, TypeEmail))
+}
+
+// domainRemove removes email address email from the aggregate reputation for its
+// domain
+func domainRemove(email string) error {
+	obj, err := normalizedObjectValue(TypeEmail, email)
+	if err != nil {
+		return err
+	}
+	return domainUpdate(map[string]*Reputation{obj: nil})
+}
+
+// domainGet returns the aggregate reputation for the domain of email address
+// email. The returned reputation has Domain set to the domain. If domain
+// reputation is disabled, the domain is excluded, or there is no aggregate
+// reputation for the domain, ErrNotFound is returned.
+func domainGet(email string) (ret Reputation, err error) {
+	if !sruntime.cfg.Domain.Enable {
+		return ret, ErrNotFound
+	}
+	obj, err := normalizedObjectValue(TypeEmail, email)
+	if err != nil {
+		return
+	}
+	key, domain, err := domainKey(obj)
+	if err != nil {
+		return
+	}
+	if domainExcluded(domain) {
+		return ret, ErrNotFound
+	}
+	ret, err = aggregateGet(key, sruntime.cfg.Domain.MinAddresses)
+	if err != nil {
+		return
+	}
+	ret.Object = obj
+	ret.Type = TypeEmail
+	ret.Domain = domain
+	return ret, nil
+}
@@ -0,0 +1,119 @@
+package iprepd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDomainKey(t *testing.T) {
+	key, domain, err := domainKey("usr@Mozilla.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "mozilla.com", domain)
+	assert.Equal(t, "_domain email mozilla.com", key)
+	_, _, err = domainKey("invalid")
+	assert.NotNil(t, err)
+	_, _, err = domainKey("invalid@")
+	assert.NotNil(t, err)
+}
+
+func TestDomainExclude(t *testing.T) {
+	var cfg ServerCfg
+	assert.Nil(t, cfg.validate())
+	assert.Equal(t, defaultDomainExclude, cfg.Domain.Exclude)
+	assert.True(t, cfg.Domain.excluded["outlook.com"])
+
+	// Configured exclusions replace the defaults, and an empty list excludes
+	// nothing
+	cfg = ServerCfg{}
+	cfg.Domain.Exclude = []string{"Example.COM"}
+	assert.Nil(t, cfg.validate())
+	assert.Equal(t, map[string]bool{"example.com": true}, cfg.Domain.excluded)
+	cfg = ServerCfg{}
+	cfg.Domain.Exclude = []string{}
+	assert.Nil(t, cfg.validate())
+	assert.Equal(t, 0, len(cfg.Domain.excluded))
+}
+
+func TestDomainReputation(t *testing.T) {
+	assert.Nil(t, baseTest())
+	origDisableAuth := sruntime.cfg.Auth.DisableAuth
+	sruntime.cfg.Auth.DisableAuth = true
+	sruntime.cfg.Domain.Enable = true
+	defer func() {
+		sruntime.cfg.Auth.DisableAuth = origDisableAuth
+		resetTestCfg()
+	}()
+	h := mwHandler(newRouter())
+
+	get := func(email string) (int, Reputation) {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/type/email/"+email, nil)
+		h.ServeHTTP(recorder, req)
+		var r Reputation
+		if recorder.Code == http.StatusOK {
+			assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &r))
+		}
+		return recorder.Code, r
+	}
+
+	_, err := applyViolationRequests(TypeEmail, "", []ViolationRequest{
+		{Object: "a@throwaway.example", Violation: "violation2"},
+		{Object: "b@throwaway.example", Violation: "violation2"},
+	})
+	assert.Nil(t, err)
+	code, _ := get("new@throwaway.example")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	_, err = applyViolationRequests(TypeEmail, "", []ViolationRequest{
+		{Object: "c@throwaway.example", Violation: "violation1"},
+	})
+	assert.Nil(t, err)
+	code, r := get("new@throwaway.example")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "new@throwaway.example", r.Object)
+	assert.Equal(t, TypeEmail, r.Type)
+	assert.Equal(t, 65, r.Reputation)
+	assert.Equal(t, "throwaway.example", r.Domain)
+
+	// Addresses with their own entry should return it
+	code, r = get("c@throwaway.example")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 95, r.Reputation)
+	assert.Equal(t, "", r.Domain)
+
+	// Other domains should be unaffected
+	code, _ = get("new@mozilla.com")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// Deleting an address removes it from the domain
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("DELETE", "/type/email/a@throwaway.example", nil)
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	code, _ = get("new@throwaway.example")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// Shared email providers are excluded, so bad addresses there don't affect
+	// other users of the provider
+	_, err = applyViolationRequests(TypeEmail, "", []ViolationRequest{
+		{Object: "a@gmail.com", Violation: "violation2"},
+		{Object: "b@gmail.com", Violation: "violation2"},
+		{Object: "c@gmail.com", Violation: "violation2"},
+	})
+	assert.Nil(t, err)
+	code, _ = get("new@gmail.com")
+	assert.Equal(t, http.StatusNotFound, code)
+	_, err = sruntime.store.Get("_domain email gmail.com")
+	assert.Equal(t, ErrNotFound, err)
+
+	// Domain entries should not be included in dumps
+	reps, err := RepDump()
+	assert.Nil(t, err)
+	for _, x := range reps {
+		assert.Equal(t, "", x.Domain)
+	}
+}
@@ -0,0 +1,87 @@
+package iprepd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EmailConfig controls how email addresses are normalized, so that different
+// forms of the same mailbox resolve to the same reputation entry
+type EmailConfig struct {
+	// LowercaseDomain lowercases the domain part of the address. The domain is
+	// also lowercased if any of the other normalizations are configured, since
+	// they match domains without regard to case.
+	LowercaseDomain bool
+
+	// LowercaseLocal lowercases the local part of the address. The local part of
+	// addresses at domains in IgnoreDots is always lowercased, since providers
+	// that ignore dots also ignore case.
+	LowercaseLocal bool
+
+	// StripPlusTags removes anything following a + in the local part of the
+	// address
+	StripPlusTags bool
+
+	// IgnoreDots lists domains whose providers ignore dots in the local part of
+	// the address, for which dots are removed and the local part is lowercased
+	IgnoreDots []string
+
+	// DomainAliases maps domains to the domain they are an alias of
+	DomainAliases map[string]string
+
+	// ignoreDots is the set of domains in IgnoreDots, lowercased
+	ignoreDots map[string]bool
+}
+
+// validate validates the configuration, and lowercases the configured domains so
+// they can be looked up directly in normalize
+func (e *EmailConfig) validate() error {
+	aliases := make(map[string]string, len(e.DomainAliases))
+	for k, v := range e.DomainAliases {
+		if k == "" || v == "" {
+			return fmt.Errorf("invalid email domain alias %v: %v", k, v)
+		}
+		aliases[strings.ToLower(k)] = strings.ToLower(v)
+	}
+	e.DomainAliases = aliases
+	e.ignoreDots = make(map[string]bool, len(e.IgnoreDots))
+	for _, x := range e.IgnoreDots {
+		e.ignoreDots[strings.ToLower(x)] = true
+	}
+	return nil
+}
+
+// enabled returns true if any normalization is configured
+func (e *EmailConfig) enabled() bool {
+	return e.LowercaseDomain || e.LowercaseLocal || e.StripPlusTags ||
+		len(e.IgnoreDots) > 0 || len(e.DomainAliases) > 0
+}
+
+// normalize returns the normalized form of email address val. If any
+// normalization is configured the domain is lowercased, so that forms of the
+// address that differ only in the case of the domain share a reputation.
+func (e *EmailConfig) normalize(val string) string {
+	if !e.enabled() {
+		return val
+	}
+	i := strings.LastIndex(val, "@")
+	if i == -1 {
+		return val
+	}
+	local, domain := val[:i], strings.ToLower(val[i+1:])
+	if v, ok := e.DomainAliases[domain]; ok {
+		domain = v
+	}
+	if e.StripPlusTags {
+		if j := strings.Index(local, "+"); j > 0 {
+			local = local[:j]
+		}
+	}
+	if e.ignoreDots[domain] {
+		local = strings.Replace(local, ".", "", -1)
+	}
+	if e.LowercaseLocal || e.ignoreDots[domain] {
+		local = strings.ToLower(local)
+	}
+	return local + "@" + domain
+}
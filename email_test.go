@@ -0,0 +1,87 @@
+package iprepd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailNormalize(t *testing.T) {
+	e := EmailConfig{
+		LowercaseDomain: true,
+		StripPlusTags:   true,
+		IgnoreDots:      []string{"gmail.com"},
+		DomainAliases:   map[string]string{"googlemail.com": "gmail.com"},
+	}
+	assert.Nil(t, e.validate())
+	tests := []struct {
+		Email    string
+		Expected string
+	}{
+		{"Foo.Bar+x@gmail.com", "foobar@gmail.com"},
+		{"Foo.Bar@GoogleMail.com", "foobar@gmail.com"},
+		{"Foo.Bar@mozilla.com", "Foo.Bar@mozilla.com"},
+		{"foobar@GMAIL.com", "foobar@gmail.com"},
+		{"foo.bar@GoogleMail.com", "foobar@gmail.com"},
+		{"foo.bar+x@mozilla.com", "foo.bar@mozilla.com"},
+		{"+foo@mozilla.com", "+foo@mozilla.com"},
+	}
+	for _, tst := range tests {
+		assert.Equal(t, tst.Expected, e.normalize(tst.Email), tst.Email)
+	}
+
+	// With no normalization configured the address is unchanged
+	var n EmailConfig
+	assert.Nil(t, n.validate())
+	assert.Equal(t, "Foo.Bar+x@GMAIL.com", n.normalize("Foo.Bar+x@GMAIL.com"))
+
+	// If any normalization is configured the domain is lowercased, and configured
+	// domains match without regard to case
+	n = EmailConfig{
+		IgnoreDots:    []string{"GMail.com"},
+		DomainAliases: map[string]string{"GoogleMail.com": "GMail.com"},
+	}
+	assert.Nil(t, n.validate())
+	assert.Equal(t, "foo@gmail.com", n.normalize("foo@GMAIL.com"))
+	assert.Equal(t, "foobar@gmail.com", n.normalize("foo.bar@GOOGLEMAIL.com"))
+	assert.Equal(t, "Foo@mozilla.com", n.normalize("Foo@MOZILLA.com"))
+	n = EmailConfig{LowercaseLocal: true}
+	assert.Nil(t, n.validate())
+	assert.Equal(t, "foo.bar@mozilla.com", n.normalize("Foo.Bar@MOZILLA.com"))
+	assert.NotNil(t, (&EmailConfig{DomainAliases: map[string]string{"googlemail.com": ""}}).validate())
+}
+
+func TestEmailNormalizeViolations(t *testing.T) {
+	assert.Nil(t, baseTest())
+	sruntime.cfg.Email = EmailConfig{
+		LowercaseDomain: true,
+		StripPlusTags:   true,
+		IgnoreDots:      []string{"gmail.com"},
+		DomainAliases:   map[string]string{"googlemail.com": "gmail.com"},
+	}
+	assert.Nil(t, sruntime.cfg.Email.validate())
+	defer func() {
+		sruntime.cfg.Email = EmailConfig{}
+	}()
+
+	results, err := applyViolationRequests(TypeEmail, "", []ViolationRequest{
+		{Object: "foobar@gmail.com", Violation: "violation1"},
+		{Object: "foo.bar+x@gmail.com", Violation: "violation1"},
+		{Object: "Foo.Bar@GoogleMail.com", Violation: "violation1"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 85, results[2].Reputation.Reputation)
+	assert.Equal(t, "foobar@gmail.com", results[2].Reputation.Object)
+
+	r, err := repGet(TypeEmail, "foo.bar+y@googlemail.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 85, r.Reputation)
+
+	// The original form of the address is kept in the history
+	hist, err := historyGet(TypeEmail, "foobar@gmail.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(hist))
+	assert.Equal(t, "", hist[0].Object)
+	assert.Equal(t, "foo.bar+x@gmail.com", hist[1].Object)
+	assert.Equal(t, "Foo.Bar@GoogleMail.com", hist[2].Object)
+}
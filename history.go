@@ -0,0 +1,158 @@
+package iprepd
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// HistoryEntry records a violation that was applied to an object
+type HistoryEntry struct {
+	// Violation is the name of the violation that was applied
+	Violation string `json:"violation"`
+
+	// Object is the object as it was submitted in the violation request, and is
+	// only set if it differs from the normalized form the reputation is stored
+	// under
+	Object string `json:"object,omitempty"`
+
+	// Penalty is the number of points the violation was configured to decrease
+	// the reputation by, including any escalation for repeat offenses and
+	// weighting for the source of the violation
+	Penalty int `json:"penalty"`
+
+	// OriginalReputation is the reputation of the object before the violation
+	// was applied
+	OriginalReputation int `json:"original_reputation"`
+
+	// Reputation is the reputation of the object after the violation was
+	// applied
+	Reputation int `json:"reputation"`
+
+	// Timestamp indicates when the violation was applied
+	Timestamp time.Time `json:"timestamp"`
+
+	// Principal is the name of the API key or Hawk ID used to submit the
+	// violation, and is empty if authentication is disabled
+	Principal string `json:"principal,omitempty"`
+
+	// Reason is the optional reason included in the violation request
+	Reason string `json:"reason,omitempty"`
+
+	// Source is the source of the violation, which is the source included in the
+	// violation request or otherwise the principal
+	Source string `json:"source,omitempty"`
+}
+
+// auxKeyMarker prefixes the keys of data stored alongside reputation entries, such
+// as violation history. Object types can not begin with this character, so these
+// keys never collide with reputation entries and can be skipped when iterating
+// over the reputation entries in the store.
+const auxKeyMarker = "_"
+
+// historyKey returns the key violation history is stored under for reputation
+// key k
+func historyKey(k string) string {
+	return auxKeyMarker + "history " + k
+}
+
+// isAuxKey returns true if k is not the key of a reputation entry
+func isAuxKey(k string) bool {
+	return strings.HasPrefix(k, auxKeyMarker)
+}
+
+// historyRecord appends entries to the violation history for the objects they were
+// applied to. The history for each object is capped to the configured number of
+// entries, with the oldest entries being discarded.
+func historyRecord(applied []appliedViolation, principal string) error {
+	if sruntime.cfg.History.Disable {
+		return nil
+	}
+	var (
+		keys    []string
+		keyIdx  = make(map[string]int)
+		entries [][]HistoryEntry
+		expiry  []time.Duration
+	)
+	for _, a := range applied {
+		if a.Err != nil || a.Duplicate {
+			continue
+		}
+		k, err := keyFromTypeAndValue(a.Result.Type, a.Result.Object)
+		if err != nil {
+			return err
+		}
+		k = historyKey(k)
+		idx, ok := keyIdx[k]
+		if !ok {
+			idx = len(keys)
+			keyIdx[k] = idx
+			keys = append(keys, k)
+			entries = append(entries, nil)
+			expiry = append(expiry, 0)
+		}
+		var obj string
+		if a.Request.Object != a.Result.Object {
+			obj = a.Request.Object
+		}
+		entries[idx] = append(entries[idx], HistoryEntry{
+			Violation:          a.Request.Violation,
+			Object:             obj,
+			Penalty:            a.Penalty,
+			OriginalReputation: a.Original.Reputation,
+			Reputation:         a.Result.Reputation,
+			Timestamp:          a.Result.LastUpdated,
+			Principal:          principal,
+			Reason:             a.Request.Reason,
+			Source:             a.Request.Source,
+		})
+		// Keep the history for at least as long as the reputation entry itself
+		e := sruntime.cfg.retention(a.Result.Type)
+		if re := a.Result.expiry(); re > e {
+			e = re
+		}
+		if e > expiry[idx] {
+			expiry[idx] = e
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return sruntime.store.Update(keys, func(i int, cur []byte) (StoreValue, error) {
+		var h []HistoryEntry
+		if cur != nil {
+			// If the existing history can't be decoded, replace it rather than
+			// failing to record the new entries
+			if json.Unmarshal(cur, &h) != nil {
+				h = nil
+			}
+		}
+		h = append(h, entries[i]...)
+		if len(h) > sruntime.cfg.History.MaxEntries {
+			h = h[len(h)-sruntime.cfg.History.MaxEntries:]
+		}
+		buf, err := json.Marshal(h)
+		if err != nil {
+			return StoreValue{}, err
+		}
+		return StoreValue{Value: buf, Expiry: expiry[i]}, nil
+	})
+}
+
+// historyGet returns the violation history for an object, oldest entry first
+func historyGet(typestr string, valstr string) (ret []HistoryEntry, err error) {
+	ret = make([]HistoryEntry, 0)
+	key, err := keyFromTypeAndValue(typestr, valstr)
+	if err != nil {
+		return
+	}
+	buf, err := sruntime.store.Get(historyKey(key))
+	if err != nil {
+		if err == ErrNotFound {
+			err = nil
+		}
+		return
+	}
+	err = json.Unmarshal(buf, &ret)
+	return
+}
@@ -1,13 +1,17 @@
 package iprepd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 )
@@ -30,12 +34,94 @@ type ViolationRequest struct {
 	// begin to recover.
 	SuppressRecovery int `json:"suppress_recovery,omitempty"`
 
+	// An optional free text reason for the violation, which is recorded in the
+	// violation history for the object.
+	Reason string `json:"reason,omitempty"`
+
+	// An optional name for the system that detected the violation. The source is
+	// recorded in the violation history namespaced under the API key name or Hawk
+	// ID used to submit the request, as principal/source, or is just the principal
+	// if not set. Penalties are scaled by the weight configured for the principal
+	// rather than the source.
+	Source string `json:"source,omitempty"`
+
+	// An optional event ID identifying the violation. If a violation with the same
+	// event ID has already been applied to the object within the configured
+	// window, the request is treated as a duplicate and not applied again. This
+	// allows requests to be safely retried.
+	EventID string `json:"event_id,omitempty"`
+
+	// Optional tags and metadata to add to the reputation entry for the object.
+	// Tags are merged with any tags the entry already has, and metadata replaces
+	// existing values for the same keys.
+	Tags     []string          `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+
 	// The IP field supports reverse compatibility with older clients. It is essentially
 	// the same thing as passing an IP address in the object field, with a type set to
 	// ip.
 	IP string `json:"ip,omitempty"`
+
+	// reporter is who the violation is attributed to for weights and
+	// corroboration, as returned by violationReporter
+	reporter string
 }
 
+// ViolationResult describes the outcome of a single ViolationRequest submitted to
+// the batch violation endpoint. Results are returned in the same order as the
+// requests were submitted.
+type ViolationResult struct {
+	// Status indicates how the request was handled, and will be one of the
+	// ViolationStatus values.
+	Status string `json:"status"`
+
+	// The object and violation from the request.
+	Object    string `json:"object,omitempty"`
+	Violation string `json:"violation,omitempty"`
+
+	// Error contains a description of the problem if the status is
+	// ViolationStatusInvalidObject or ViolationStatusError.
+	Error string `json:"error,omitempty"`
+
+	// Reputation is the resulting reputation for the object if the violation
+	// was applied.
+	Reputation *Reputation `json:"reputation,omitempty"`
+}
+
+const (
+	// ViolationStatusApplied indicates the violation was applied
+	ViolationStatusApplied = "applied"
+
+	// ViolationStatusUnknownViolation indicates the violation is not configured
+	// in iprepd, and was ignored
+	ViolationStatusUnknownViolation = "unknown_violation"
+
+	// ViolationStatusInvalidObject indicates the request failed validation, for
+	// example because the object is not valid for the type, and was ignored
+	ViolationStatusInvalidObject = "invalid_object"
+
+	// ViolationStatusExcepted indicates the violation was applied, but the object
+	// matches an exception so the reputation will not be returned in lookups
+	ViolationStatusExcepted = "excepted"
+
+	// ViolationStatusPinned indicates the violation was recorded, but the
+	// reputation for the object is pinned so the score was not changed
+	ViolationStatusPinned = "pinned"
+
+	// ViolationStatusOverBudget indicates the violation was recorded, but the
+	// penalty was not fully applied because the object has lost the maximum
+	// number of points allowed by the penalty budget
+	ViolationStatusOverBudget = "over_budget"
+
+	// ViolationStatusDuplicate indicates a violation with the same event ID has
+	// already been applied to the object, and the request was ignored
+	ViolationStatusDuplicate = "duplicate"
+
+	// ViolationStatusError indicates an error occurred applying the violation;
+	// the request can be retried
+	ViolationStatusError = "error"
+)
+
 const (
 	// TypeIP is the object type for IP addresses
 	TypeIP = "ip"
@@ -44,6 +130,31 @@ const (
 	TypeEmail = "email"
 )
 
+// PinRequest is used to pin the reputation for an object to a fixed score. While
+// pinned, violations and decay do not change the score of the object.
+type PinRequest struct {
+	// The score the reputation should be pinned to
+	Reputation int `json:"reputation"`
+
+	// An optional time after which the pin expires. If not set the reputation is
+	// pinned until it is unpinned.
+	Expires time.Time `json:"expires,omitempty"`
+
+	// An optional free text reason the reputation was pinned
+	Reason string `json:"reason,omitempty"`
+}
+
+// Validate performs validation of a PinRequest type
+func (p *PinRequest) Validate() error {
+	if p.Reputation < 0 || p.Reputation > 100 {
+		return fmt.Errorf("invalid reputation score %v", p.Reputation)
+	}
+	if !p.Expires.IsZero() && !p.Expires.After(time.Now()) {
+		return fmt.Errorf("pin expiry %v is in the past", p.Expires)
+	}
+	return nil
+}
+
 // Fixup is used to convert legacy format violations
 func (v *ViolationRequest) Fixup(typestr string) {
 	// Only apply fixup to ip type requests
@@ -75,7 +186,10 @@ func (v *ViolationRequest) Validate() error {
 	if v.SuppressRecovery > 1209600 {
 		return fmt.Errorf("invalid suppress recovery value %v", v.SuppressRecovery)
 	}
-	return nil
+	if len(v.EventID) > 256 {
+		return fmt.Errorf("event id exceeds maximum length")
+	}
+	return validateTags(v.Tags, v.Metadata)
 }
 
 func mwHandler(h http.Handler) http.Handler {
@@ -94,7 +208,9 @@ func mwHandler(h http.Handler) http.Handler {
 }
 
 func newRouter() *mux.Router {
-	r := mux.NewRouter().StrictSlash(true)
+	// Match routes against the encoded path, so object values can contain
+	// escaped slashes (for example CIDR notation)
+	r := mux.NewRouter().StrictSlash(true).UseEncodedPath()
 
 	// Unauthenticated endpoints
 	r.HandleFunc("/__lbheartbeat__", httpHeartbeat).Methods("GET")
@@ -103,11 +219,15 @@ func newRouter() *mux.Router {
 
 	r.HandleFunc("/violations", auth(httpGetViolations, false)).Methods("GET")
 	r.HandleFunc("/dump", auth(httpGetAllReputation, true)).Methods("GET")
-	r.HandleFunc("/type/{type:[a-z]{1,12}}/{value}", auth(httpGetReputation, false)).Methods("GET")
-	r.HandleFunc("/type/{type:[a-z]{1,12}}/{value}", auth(httpPutReputation, true)).Methods("PUT")
-	r.HandleFunc("/type/{type:[a-z]{1,12}}/{value}", auth(httpDeleteReputation, true)).Methods("DELETE")
-	r.HandleFunc("/violations/type/{type:[a-z]{1,12}}/{value}", auth(httpPutViolation, true)).Methods("PUT")
-	r.HandleFunc("/violations/type/{type:[a-z]{1,12}}", auth(httpPutViolations, true)).Methods("PUT")
+	r.HandleFunc("/type/{type}/{value}", auth(httpGetReputation, false)).Methods("GET")
+	r.HandleFunc("/type/{type}/{value}", auth(httpPutReputation, true)).Methods("PUT")
+	r.HandleFunc("/type/{type}/{value}", auth(httpDeleteReputation, true)).Methods("DELETE")
+	r.HandleFunc("/type/{type}/{value}/history", auth(httpGetHistory, false)).Methods("GET")
+	r.HandleFunc("/type/{type}/{value}/pin", auth(httpPutPin, true)).Methods("PUT")
+	r.HandleFunc("/type/{type}/{value}/pin", auth(httpDeletePin, true)).Methods("DELETE")
+	r.HandleFunc("/violations/type/{type}/{value}", auth(httpPutViolation, true)).Methods("PUT")
+	r.HandleFunc("/violations/type/{type}", auth(httpPutViolations, true)).Methods("PUT")
+	r.HandleFunc("/simulate/violations/type/{type}", auth(httpSimulateViolations, false)).Methods("PUT")
 
 	// Legacy IP reputation endpoint for get ip
 	//
@@ -121,8 +241,25 @@ func newRouter() *mux.Router {
 	return r
 }
 
+// startAPI serves the API until the process receives SIGINT or SIGTERM, at which
+// point in flight requests are allowed to complete and nil is returned
 func startAPI() error {
-	return http.ListenAndServe(sruntime.cfg.Listen, mwHandler(newRouter()))
+	srv := &http.Server{Addr: sruntime.cfg.Listen, Handler: mwHandler(newRouter())}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		log.Infof("shutting down API")
+		err := srv.Shutdown(context.Background())
+		if err != nil {
+			log.Errorf("Error shutting down API: %s", err)
+		}
+	}()
+	err := srv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
 }
 
 func wrapLegacyIPRequest(rf func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
@@ -136,8 +273,7 @@ func wrapLegacyIPRequest(rf func(http.ResponseWriter, *http.Request)) func(http.
 
 func hasValidType(r *http.Request) error {
 	t := mux.Vars(r)["type"]
-	_, ok := validators[t]
-	if !ok {
+	if !isValidType(t) {
 		return fmt.Errorf("type %v is invalid", t)
 	}
 	return nil
@@ -152,7 +288,10 @@ func verifyTypeAndValue(r *http.Request) (t string, v string, err error) {
 	if t == "" {
 		return t, v, fmt.Errorf("type was not set")
 	}
-	v = mux.Vars(r)["value"]
+	v, err = url.PathUnescape(mux.Vars(r)["value"])
+	if err != nil {
+		return t, v, err
+	}
 	if v == "" {
 		return t, v, fmt.Errorf("value was not set")
 	}
@@ -164,7 +303,7 @@ func httpVersion(w http.ResponseWriter, r *http.Request) {
 }
 
 func httpHeartbeat(w http.ResponseWriter, r *http.Request) {
-	_, err := sruntime.redis.ping().Result()
+	err := sruntime.store.Ping()
 	if err != nil {
 		log.Warnf(err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
@@ -182,7 +321,17 @@ func defaultHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func httpGetViolations(w http.ResponseWriter, r *http.Request) {
-	buf, err := json.Marshal(sruntime.cfg.Violations)
+	vs := sruntime.cfg.Violations
+	// If a type is specified, return the violations that apply to that type
+	if typestr := r.URL.Query().Get("type"); typestr != "" {
+		if !isValidType(typestr) {
+			log.Warnf("type %v is invalid", typestr)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		vs = sruntime.cfg.typeViolations(typestr)
+	}
+	buf, err := json.Marshal(vs)
 	if err != nil {
 		log.Warnf(err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
@@ -193,24 +342,42 @@ func httpGetViolations(w http.ResponseWriter, r *http.Request) {
 }
 
 func httpGetAllReputation(w http.ResponseWriter, r *http.Request) {
-	allRep, err := RepDump()
-	if err != nil {
-		if err == redis.Nil {
-			w.WriteHeader(http.StatusNotFound)
-			return
+	// Stream the entries to the client as they are read from the store rather than
+	// building the entire response in memory. Once the first entry has been written
+	// we can no longer return an error status, so errors past that point result in
+	// a truncated response.
+	wrote := false
+	err := RepDumpTagsFunc(r.URL.Query()["tag"], func(rep Reputation) error {
+		rep.applyBand()
+		buf, err := json.Marshal(rep)
+		if err != nil {
+			return err
+		}
+		if !wrote {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("["))
+			wrote = true
+		} else {
+			w.Write([]byte(","))
 		}
+		_, err = w.Write(buf)
+		return err
+	})
+	if err != nil {
 		log.Warnf(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		if !wrote {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
 		return
 	}
-	buf, err := json.Marshal(allRep)
-	if err != nil {
-		log.Warnf(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+	// An empty dump is encoded as null, matching the encoding of an empty list
+	// of entries before the response was streamed
+	if !wrote {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("null"))
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(buf)
+	w.Write([]byte("]"))
 }
 
 func httpGetReputation(w http.ResponseWriter, r *http.Request) {
@@ -239,8 +406,16 @@ func httpGetReputation(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	rep, err := repGet(typestr, valstr)
+	// If the object has no entry of its own, fall back to the aggregate
+	// reputation for the enclosing network or email domain
+	if err == ErrNotFound && typestr == TypeIP {
+		rep, err = subnetGet(valstr)
+	}
+	if err == ErrNotFound && typestr == TypeEmail {
+		rep, err = domainGet(valstr)
+	}
 	if err != nil {
-		if err == redis.Nil {
+		if err == ErrNotFound {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
@@ -248,6 +423,12 @@ func httpGetReputation(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	// If tags were specified, only return the entry if it has all of them
+	if !rep.HasTags(r.URL.Query()["tag"]...) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	rep.applyBand()
 	buf, err := json.Marshal(rep)
 	if err != nil {
 		log.Warnf(err.Error())
@@ -286,12 +467,18 @@ func httpPutReputation(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	err = rep.set()
+	err = repSet(&rep)
 	if err != nil {
 		log.Warnf(err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	// A manually set reputation takes precedence over violations, so the object
+	// no longer contributes to the reputation of the network or email domain
+	err = aggregateRemove(rep.Type, rep.Object)
+	if err != nil {
+		log.Errorf("Error updating aggregate reputation: %s", err)
+	}
 	exc := false
 	if rep.Type == TypeIP {
 		exc, err = isException(rep.Object)
@@ -319,6 +506,115 @@ func httpDeleteReputation(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	// The entry has already been deleted, so a failure to update the aggregate
+	// reputation is logged but does not fail the request
+	err = aggregateRemove(typestr, valstr)
+	if err != nil {
+		log.Errorf("Error updating aggregate reputation: %s", err)
+	}
+}
+
+func httpGetHistory(w http.ResponseWriter, r *http.Request) {
+	typestr, valstr, err := verifyTypeAndValue(r)
+	if err != nil {
+		log.Warnf(err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	h, err := historyGet(typestr, valstr)
+	if err != nil {
+		log.Warnf(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	buf, err := json.Marshal(h)
+	if err != nil {
+		log.Warnf(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+func httpPutPin(w http.ResponseWriter, r *http.Request) {
+	typestr, valstr, err := verifyTypeAndValue(r)
+	if err != nil {
+		log.Warnf(err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Warnf(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var p PinRequest
+	err = json.Unmarshal(buf, &p)
+	if err != nil {
+		log.Warnf(err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = p.Validate()
+	if err != nil {
+		log.Warnf(err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rep, err := repPin(typestr, valstr, p.Reputation, p.Expires.UTC(), p.Reason)
+	if err != nil {
+		log.Warnf(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// As with a manually set reputation, a pinned object no longer contributes to
+	// the reputation of the network or email domain
+	err = aggregateRemove(typestr, valstr)
+	if err != nil {
+		log.Errorf("Error updating aggregate reputation: %s", err)
+	}
+	log.WithFields(log.Fields{
+		"object":      rep.Object,
+		"type":        rep.Type,
+		"reputation":  rep.Reputation,
+		"pin_expires": rep.PinExpires,
+		"pin_reason":  rep.PinReason,
+		"principal":   requestPrincipal(r),
+	}).Info("reputation pinned")
+	buf, err = json.Marshal(rep)
+	if err != nil {
+		log.Warnf(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+func httpDeletePin(w http.ResponseWriter, r *http.Request) {
+	typestr, valstr, err := verifyTypeAndValue(r)
+	if err != nil {
+		log.Warnf(err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = repUnpin(typestr, valstr)
+	if err != nil {
+		if err == ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Warnf(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.WithFields(log.Fields{
+		"object":    valstr,
+		"type":      typestr,
+		"principal": requestPrincipal(r),
+	}).Info("reputation unpinned")
 }
 
 func httpPutViolation(w http.ResponseWriter, r *http.Request) {
@@ -343,10 +639,32 @@ func httpPutViolation(w http.ResponseWriter, r *http.Request) {
 	// Force object field and type to match value specified in request path
 	v.Object = valstr
 	v.Type = typestr
-	httpPutViolationsInner(w, r, typestr, []ViolationRequest{v})
+	results, err := applyViolationRequests(typestr, requestPrincipal(r), []ViolationRequest{v})
+	if err != nil {
+		log.Warnf(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	switch results[0].Status {
+	case ViolationStatusInvalidObject:
+		w.WriteHeader(http.StatusBadRequest)
+	case ViolationStatusError:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
 }
 
 func httpPutViolations(w http.ResponseWriter, r *http.Request) {
+	putViolations(w, r, applyViolationRequests)
+}
+
+func httpSimulateViolations(w http.ResponseWriter, r *http.Request) {
+	putViolations(w, r, simulateViolationRequests)
+}
+
+// putViolations handles a batch of violation requests using fn, and writes the
+// results to the response
+func putViolations(w http.ResponseWriter, r *http.Request,
+	fn func(string, string, []ViolationRequest) ([]ViolationResult, error)) {
 	// We only have a type to verify here
 	err := hasValidType(r)
 	if err != nil {
@@ -367,96 +685,169 @@ func httpPutViolations(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	httpPutViolationsInner(w, r, typestr, vs)
+	results, err := fn(typestr, requestPrincipal(r), vs)
+	if err != nil {
+		log.Warnf(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	buf, err = json.Marshal(results)
+	if err != nil {
+		log.Warnf(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+// applyViolationRequests validates and applies a set of violation requests for
+// objects of type typestr submitted by principal, returning the result for each
+// request. Requests that fail validation or reference unknown violations are
+// skipped, and the remaining requests are applied. An error is returned if the
+// store could not be updated, in which case none of the requests were applied.
+func applyViolationRequests(typestr string, principal string, vs []ViolationRequest) ([]ViolationResult, error) {
+	return handleViolationRequests(typestr, principal, vs, false)
 }
 
-func httpPutViolationsInner(w http.ResponseWriter, r *http.Request, typestr string, vs []ViolationRequest) {
-	for _, v := range vs {
+// simulateViolationRequests validates a set of violation requests for objects of
+// type typestr, returning the result each request would have if it was applied.
+// Nothing is written to the store.
+func simulateViolationRequests(typestr string, principal string, vs []ViolationRequest) ([]ViolationResult, error) {
+	return handleViolationRequests(typestr, principal, vs, true)
+}
+
+func handleViolationRequests(typestr string, principal string, vs []ViolationRequest, simulate bool) ([]ViolationResult, error) {
+	var (
+		results  = make([]ViolationResult, len(vs))
+		apply    = make([]ViolationRequest, 0, len(vs))
+		applyIdx = make([]int, 0, len(vs))
+	)
+	for i, v := range vs {
 		v.Fixup(typestr)
 		// Force type field to match value specified in request path
 		v.Type = typestr
+		v.reporter, v.Source = violationReporter(principal, v.Source)
+		results[i].Object = v.Object
+		results[i].Violation = v.Violation
+
 		err := v.Validate()
+		if err == nil {
+			err = validateType(v.Type, v.Object)
+		}
 		if err != nil {
 			log.Warnf(err.Error())
-			w.WriteHeader(http.StatusBadRequest)
-			return
+			results[i].Status = ViolationStatusInvalidObject
+			results[i].Error = err.Error()
+			continue
 		}
 
-		if err = validateType(v.Type, v.Object); err != nil {
-			log.Warnf(err.Error())
-			w.WriteHeader(http.StatusBadRequest)
-			return
+		// Don't treat submitting an unknown violation as an error, instead just
+		// log it
+		if sruntime.cfg.getViolation(v.Type, v.Violation) == nil {
+			log.WithFields(log.Fields{
+				"violation": v.Violation,
+				"object":    v.Object,
+				"type":      v.Type,
+			}).Warn("ignoring unknown violation")
+			results[i].Status = ViolationStatusUnknownViolation
+			continue
 		}
 
-		rep, err := repGet(typestr, v.Object)
-		if err == redis.Nil {
-			rep = Reputation{
-				Object:     v.Object,
-				Type:       typestr,
-				Reputation: 100,
-			}
-		} else if err != nil {
-			log.Warnf(err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+		apply = append(apply, v)
+		applyIdx = append(applyIdx, i)
+	}
 
-		err = rep.Validate()
+	var (
+		applied []appliedViolation
+		err     error
+	)
+	if simulate {
+		applied, err = repSimulateViolations(apply)
 		if err != nil {
-			log.Warnf(err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return nil, err
 		}
-
-		// If recovery suppression was specified add the correct timestamp to the reputation
-		// entry. Is suppression is already indicated, only update it if it results in a new
-		// timestamp that is beyond what the existing value is.
-		if v.SuppressRecovery > 0 {
-			nd := time.Now().UTC().Add(time.Second *
-				time.Duration(v.SuppressRecovery))
-			if rep.DecayAfter.IsZero() || rep.DecayAfter.Before(nd) {
-				rep.DecayAfter = nd
-			}
+	} else {
+		applied, err = repApplyViolations(apply)
+		if err != nil {
+			return nil, err
 		}
-
-		origRep := rep.Reputation
-		found, err := rep.applyViolation(v.Violation)
+		// The violations have already been applied at this point, so a failure to
+		// record history is logged rather than returned to the client
+		err = historyRecord(applied, principal)
 		if err != nil {
-			if !found {
-				// Don't treat submitting an unknown violation as an error, instead
-				// just log it
-				log.WithFields(log.Fields{
-					"violation": v.Violation,
-					"object":    v.Object,
-					"type":      v.Type,
-				}).Warn("ignoring unknown violation")
-				continue
-			}
-			log.Warnf(err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			log.Errorf("Error recording violation history: %s", err)
 		}
-		err = rep.set()
+		err = subnetRecord(applied)
 		if err != nil {
-			log.Warnf(err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			log.Errorf("Error updating subnet reputation: %s", err)
+		}
+		err = domainRecord(applied)
+		if err != nil {
+			log.Errorf("Error updating domain reputation: %s", err)
+		}
+	}
+	for j, a := range applied {
+		res := &results[applyIdx[j]]
+		if a.Err != nil {
+			log.Warnf(a.Err.Error())
+			res.Status = ViolationStatusError
+			res.Error = a.Err.Error()
+			continue
+		}
+		rep := a.Result
+		res.Reputation = &rep
+		if a.Duplicate {
+			res.Status = ViolationStatusDuplicate
+			if !simulate {
+				log.WithFields(log.Fields{
+					"violation": a.Request.Violation,
+					"object":    rep.Object,
+					"type":      rep.Type,
+					"event_id":  a.Request.EventID,
+					"principal": principal,
+				}).Info("ignoring duplicate violation")
+			}
+			continue
 		}
+		res.Status = ViolationStatusApplied
 		exc := false
 		if rep.Type == TypeIP {
 			exc, err = isException(rep.Object)
 			if err != nil {
 				log.Errorf("Error looking up exception: %s", err)
 			}
+			if exc {
+				res.Status = ViolationStatusExcepted
+			}
+		}
+		if !exc && rep.IsPinned() {
+			res.Status = ViolationStatusPinned
+		}
+		if !exc && a.OverBudget {
+			res.Status = ViolationStatusOverBudget
+		}
+		if simulate {
+			// Include the band the reputation would fall in, to help with tuning
+			// penalties against the configured bands
+			rep.applyBand()
+			continue
 		}
 		log.WithFields(log.Fields{
-			"violation":           v.Violation,
+			"violation":           a.Request.Violation,
 			"object":              rep.Object,
 			"type":                rep.Type,
 			"reputation":          rep.Reputation,
 			"decay_after":         rep.DecayAfter,
-			"original_reputation": origRep,
+			"original_reputation": a.Original.Reputation,
 			"exception":           exc,
+			"pinned":              rep.IsPinned(),
+			"event_id":            a.Request.EventID,
+			"source":              a.Request.Source,
+			"penalty":             a.Penalty,
+			"over_budget":         a.OverBudget,
+			"principal":           principal,
 		}).Info("violation applied")
 	}
+	return results, nil
 }
@@ -3,9 +3,13 @@ package iprepd
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -575,7 +579,16 @@ func TestHandlers(t *testing.T) {
 	req = httptest.NewRequest("PUT", "/violations/type/ip", bytes.NewReader([]byte(buf2)))
 	req.Header.Set("Content-Type", "application/json")
 	h.ServeHTTP(recorder, req)
-	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	res = recorder.Result()
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	var results []ViolationResult
+	err = json.Unmarshal(recorder.Body.Bytes(), &results)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, ViolationStatusInvalidObject, results[0].Status)
+	assert.Equal(t, ViolationStatusApplied, results[1].Status)
+	assert.Equal(t, "192.168.5.1", results[1].Reputation.Object)
 
 	// put violations for malformed email
 	recorder = httptest.NewRecorder()
@@ -584,7 +597,32 @@ func TestHandlers(t *testing.T) {
 	req = httptest.NewRequest("PUT", "/violations/type/email", bytes.NewReader([]byte(buf2)))
 	req.Header.Set("Content-Type", "application/json")
 	h.ServeHTTP(recorder, req)
-	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	err = json.Unmarshal(recorder.Body.Bytes(), &results)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, ViolationStatusInvalidObject, results[0].Status)
+	assert.Equal(t, "invalid email format rikermozilla.com", results[0].Error)
+	assert.Equal(t, ViolationStatusApplied, results[1].Status)
+	assert.Equal(t, "troi@mozilla.com", results[1].Reputation.Object)
+	assert.Equal(t, 50, results[1].Reputation.Reputation)
+
+	// put violations with an entry which cannot be loaded from the store
+	kv, _ := keyFromTypeAndValue(TypeIP, "192.168.9.1")
+	err = sruntime.store.Set(kv, []byte("{invalid"), 0)
+	assert.Nil(t, err)
+	recorder = httptest.NewRecorder()
+	buf2 = "[{\"object\": \"192.168.9.1\", \"type\": \"ip\", \"violation\": \"violation1\"}," +
+		"{\"object\": \"192.168.9.2\", \"type\": \"ip\", \"violation\": \"violation1\"}]"
+	req = httptest.NewRequest("PUT", "/violations/type/ip", bytes.NewReader([]byte(buf2)))
+	req.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	err = json.Unmarshal(recorder.Body.Bytes(), &results)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, ViolationStatusError, results[0].Status)
+	assert.Equal(t, ViolationStatusApplied, results[1].Status)
 }
 
 func TestViolationDecreaseLimit(t *testing.T) {
@@ -733,7 +771,7 @@ func TestDecay(t *testing.T) {
 	buf, err := json.Marshal(r)
 	assert.Nil(t, err)
 	kv, _ := keyFromTypeAndValue(TypeIP, "192.168.2.1")
-	err = sruntime.redis.set(kv, buf, 0).Err()
+	err = sruntime.store.Set(kv, buf, 0)
 
 	// initial request with default (no) decay
 	recorder := httptest.NewRecorder()
@@ -796,7 +834,7 @@ func TestDecayAfter(t *testing.T) {
 	buf, err := json.Marshal(r)
 	assert.Nil(t, err)
 	kv, _ := keyFromTypeAndValue(TypeIP, "192.168.2.1")
-	err = sruntime.redis.set(kv, buf, 0).Err()
+	err = sruntime.store.Set(kv, buf, 0)
 
 	// initial request with default (no) decay
 	recorder := httptest.NewRecorder()
@@ -846,7 +884,7 @@ func TestDecayAfterPast(t *testing.T) {
 	buf, err := json.Marshal(r)
 	assert.Nil(t, err)
 	kv, _ := keyFromTypeAndValue(TypeIP, "192.168.2.1")
-	err = sruntime.redis.set(kv, buf, 0).Err()
+	err = sruntime.store.Set(kv, buf, 0)
 
 	// initial request with default (no) decay
 	recorder := httptest.NewRecorder()
@@ -972,7 +1010,7 @@ func TestReviewedReset(t *testing.T) {
 	buf2, err = json.Marshal(r)
 	assert.Nil(t, err)
 	kv, _ := keyFromTypeAndValue(TypeIP, "192.168.4.1")
-	err = sruntime.redis.set(kv, buf, 0).Err()
+	err = sruntime.store.Set(kv, buf2, 0)
 	assert.Nil(t, err)
 	recorder = httptest.NewRecorder()
 	req = httptest.NewRequest("GET", "/type/ip/192.168.4.1", nil)
@@ -1038,6 +1076,714 @@ func TestZeroViolation(t *testing.T) {
 	assert.Equal(t, false, r.Reviewed)
 }
 
+func TestBatchViolationsDuplicates(t *testing.T) {
+	assert.Nil(t, baseTest())
+	sruntime.cfg.Auth.DisableAuth = true
+	h := mwHandler(newRouter())
+
+	// Submit a batch where several of the requests apply to the same object,
+	// including IPv6 addresses that collapse to the same prefix; each request
+	// should be applied in order
+	recorder := httptest.NewRecorder()
+	buf := "[{\"object\": \"192.168.8.1\", \"type\": \"ip\", \"violation\": \"violation1\"}," +
+		"{\"object\": \"192.168.8.2\", \"type\": \"ip\", \"violation\": \"violation2\"}," +
+		"{\"object\": \"192.168.8.1\", \"type\": \"ip\", \"violation\": \"violation1\"}," +
+		"{\"object\": \"192.168.0.1\", \"type\": \"ip\", \"violation\": \"violation1\"}," +
+		"{\"object\": \"2001:db8:bbb::1\", \"type\": \"ip\", \"violation\": \"violation1\"}," +
+		"{\"object\": \"2001:db8:bbb::2\", \"type\": \"ip\", \"violation\": \"violation1\"}," +
+		"{\"object\": \"192.168.8.1\", \"type\": \"ip\", \"violation\": \"violation1\"}]"
+	req := httptest.NewRequest("PUT", "/violations/type/ip", bytes.NewReader([]byte(buf)))
+	req.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	tests := []struct {
+		Object     string
+		Reputation int
+	}{
+		{"192.168.8.1", 85},
+		{"192.168.8.2", 50},
+		{"192.168.0.1", 45},
+		{"2001:db8:bbb::", 90},
+	}
+	for _, tst := range tests {
+		r, err := repGet(TypeIP, tst.Object)
+		assert.Nil(t, err)
+		assert.Equal(t, tst.Object, r.Object)
+		assert.Equal(t, tst.Reputation, r.Reputation, tst.Object)
+	}
+}
+
+func TestConcurrentViolations(t *testing.T) {
+	assert.Nil(t, baseTest())
+	sruntime.cfg.Auth.DisableAuth = true
+	h := mwHandler(newRouter())
+
+	// Submit violations for the same object concurrently; each of the violations
+	// should be applied and none of the penalties lost
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recorder := httptest.NewRecorder()
+			buf := "{\"object\": \"192.168.6.1\", \"type\": \"ip\", \"violation\": \"violation1\"}"
+			req := httptest.NewRequest("PUT", "/violations/type/ip/192.168.6.1", bytes.NewReader([]byte(buf)))
+			req.Header.Set("Content-Type", "application/json")
+			h.ServeHTTP(recorder, req)
+			assert.Equal(t, http.StatusOK, recorder.Code)
+		}()
+	}
+	wg.Wait()
+
+	r, err := repGet(TypeIP, "192.168.6.1")
+	assert.Nil(t, err)
+	assert.Equal(t, 50, r.Reputation)
+}
+
+func TestDumpBatches(t *testing.T) {
+	assert.Nil(t, baseTest())
+	sruntime.cfg.Auth.DisableAuth = true
+	h := mwHandler(newRouter())
+
+	// Add enough entries to the fixture entries from baseTest that the dump has
+	// to be read from the store in several batches
+	fixture, err := RepDump()
+	assert.Nil(t, err)
+	n := dumpBatchSize*2 + 500
+	for i := 0; i < n; i++ {
+		r := Reputation{
+			Object:     fmt.Sprintf("10.1.%v.%v", i/256, i%256),
+			Type:       TypeIP,
+			Reputation: 50,
+		}
+		assert.Nil(t, r.set())
+	}
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/dump", nil)
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	res := recorder.Result()
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	buf, err := ioutil.ReadAll(res.Body)
+	assert.Nil(t, err)
+	var reputations []Reputation
+	err = json.Unmarshal(buf, &reputations)
+	assert.Nil(t, err)
+	assert.Equal(t, len(fixture)+n, len(reputations))
+
+	// Returning an error from the callback should stop iteration
+	stop := errors.New("stop")
+	cnt := 0
+	err = RepDumpFunc(func(r Reputation) error {
+		cnt++
+		if cnt == 10 {
+			return stop
+		}
+		return nil
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 10, cnt)
+
+	// An empty store should return null, as it did before the dump was streamed
+	assert.Nil(t, flushStore())
+	recorder = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/dump", nil)
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "null", recorder.Body.String())
+	reputations, err = RepDump()
+	assert.Nil(t, err)
+	assert.Nil(t, reputations)
+}
+
+func TestViolationHistory(t *testing.T) {
+	assert.Nil(t, baseTest())
+	sruntime.cfg.Auth.DisableAuth = false
+	defer func() { sruntime.cfg.Auth.DisableAuth = true }()
+	h := mwHandler(newRouter())
+
+	recorder := httptest.NewRecorder()
+	buf := "{\"object\": \"192.168.0.1\", \"type\": \"ip\", \"violation\": \"violation1\", " +
+		"\"reason\": \"too many login failures\"}"
+	req := httptest.NewRequest("PUT", "/violations/type/ip/192.168.0.1", bytes.NewReader([]byte(buf)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "APIKey key1")
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	buf = "[{\"object\": \"192.168.0.1\", \"type\": \"ip\", \"violation\": \"violation2\"}," +
+		"{\"object\": \"192.168.0.1\", \"type\": \"ip\", \"violation\": \"unknown\"}," +
+		"{\"object\": \"192.168.0.2\", \"type\": \"ip\", \"violation\": \"violation2\"}]"
+	req = httptest.NewRequest("PUT", "/violations/type/ip", bytes.NewReader([]byte(buf)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "APIKey key2")
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/type/ip/192.168.0.1/history", nil)
+	req.Header.Set("Authorization", "APIKey rokey1")
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var hist []HistoryEntry
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &hist))
+	assert.Equal(t, 2, len(hist))
+	assert.Equal(t, "violation1", hist[0].Violation)
+	assert.Equal(t, 5, hist[0].Penalty)
+	assert.Equal(t, 50, hist[0].OriginalReputation)
+	assert.Equal(t, 45, hist[0].Reputation)
+	assert.Equal(t, "u1", hist[0].Principal)
+	assert.Equal(t, "too many login failures", hist[0].Reason)
+	assert.False(t, hist[0].Timestamp.IsZero())
+	assert.Equal(t, "violation2", hist[1].Violation)
+	assert.Equal(t, 50, hist[1].Penalty)
+	assert.Equal(t, 45, hist[1].OriginalReputation)
+	assert.Equal(t, 45, hist[1].Reputation)
+	assert.Equal(t, "u2", hist[1].Principal)
+	assert.Equal(t, "", hist[1].Reason)
+
+	// An object without any violations should have an empty history
+	recorder = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/type/email/usr@mozilla.com/history", nil)
+	req.Header.Set("Authorization", "APIKey key1")
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "[]", recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/type/ip/invalid/history", nil)
+	req.Header.Set("Authorization", "APIKey key1")
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	// History should not be included in dumps
+	reps, err := RepDump()
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(reps))
+
+	// The history should be capped to the configured number of entries
+	orig := sruntime.cfg.History.MaxEntries
+	defer func() { sruntime.cfg.History.MaxEntries = orig }()
+	sruntime.cfg.History.MaxEntries = 3
+	for i := 0; i < 5; i++ {
+		_, err := applyViolationRequests(TypeIP, "", []ViolationRequest{
+			{Object: "192.168.0.2", Type: TypeIP, Violation: "violation3"},
+		})
+		assert.Nil(t, err)
+	}
+	hist, err = historyGet(TypeIP, "192.168.0.2")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(hist))
+	for _, e := range hist {
+		assert.Equal(t, "violation3", e.Violation)
+	}
+
+	// Deleting the reputation should also remove the history
+	recorder = httptest.NewRecorder()
+	req = httptest.NewRequest("DELETE", "/type/ip/192.168.0.1", nil)
+	req.Header.Set("Authorization", "APIKey key1")
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	hist, err = historyGet(TypeIP, "192.168.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(hist))
+}
+
+func TestTypeViolations(t *testing.T) {
+	assert.Nil(t, baseTest())
+	sruntime.cfg.Auth.DisableAuth = true
+	defer func() { sruntime.cfg.TypeViolations = nil }()
+	sruntime.cfg.TypeViolations = map[string][]Violation{
+		TypeEmail: {
+			{Name: "violation1", Penalty: 30, DecreaseLimit: 0},
+			{Name: "spam", Penalty: 10, DecreaseLimit: 0},
+		},
+	}
+	h := mwHandler(newRouter())
+
+	// Violations for the type take precedence, and global violations apply
+	// otherwise
+	results, err := applyViolationRequests(TypeEmail, "", []ViolationRequest{
+		{Object: "usr@mozilla.com", Violation: "violation1"},
+		{Object: "usr@mozilla.com", Violation: "spam"},
+		{Object: "usr@mozilla.com", Violation: "violation2"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 20, results[0].Reputation.Reputation)
+	assert.Equal(t, 10, results[1].Reputation.Reputation)
+	assert.Equal(t, ViolationStatusApplied, results[2].Status)
+	assert.Equal(t, 10, results[2].Reputation.Reputation)
+
+	// Type specific violations don't apply to other types
+	results, err = applyViolationRequests(TypeIP, "", []ViolationRequest{
+		{Object: "192.168.0.1", Violation: "violation1"},
+		{Object: "192.168.0.1", Violation: "spam"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 45, results[0].Reputation.Reputation)
+	assert.Equal(t, ViolationStatusUnknownViolation, results[1].Status)
+
+	tests := []struct {
+		Query  string
+		Code   int
+		Expect string
+	}{
+		{"", http.StatusOK, "[{\"name\":\"violation1\",\"penalty\":5,\"decreaselimit\":25}," +
+			"{\"name\":\"violation2\",\"penalty\":50,\"decreaselimit\":50}," +
+			"{\"name\":\"violation3\",\"penalty\":0,\"decreaselimit\":0}]"},
+		{"?type=email", http.StatusOK, "[{\"name\":\"violation1\",\"penalty\":30,\"decreaselimit\":0}," +
+			"{\"name\":\"spam\",\"penalty\":10,\"decreaselimit\":0}," +
+			"{\"name\":\"violation2\",\"penalty\":50,\"decreaselimit\":50}," +
+			"{\"name\":\"violation3\",\"penalty\":0,\"decreaselimit\":0}]"},
+		{"?type=invalid", http.StatusBadRequest, ""},
+	}
+	for _, tst := range tests {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/violations"+tst.Query, nil)
+		h.ServeHTTP(recorder, req)
+		assert.Equal(t, tst.Code, recorder.Code, tst.Query)
+		assert.Equal(t, tst.Expect, recorder.Body.String(), tst.Query)
+	}
+}
+
+func TestReputationTags(t *testing.T) {
+	assert.Nil(t, baseTest())
+	sruntime.cfg.Auth.DisableAuth = true
+	h := mwHandler(newRouter())
+
+	recorder := httptest.NewRecorder()
+	buf := "{\"object\": \"192.168.0.1\", \"type\": \"ip\", \"violation\": \"violation1\", " +
+		"\"tags\": [\"fxa\", \"credential-stuffing\"], \"metadata\": {\"ticket\": \"1234\"}}"
+	req := httptest.NewRequest("PUT", "/violations/type/ip/192.168.0.1", bytes.NewReader([]byte(buf)))
+	req.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// Tags should be merged into the entry, and metadata replaced by key
+	results, err := applyViolationRequests(TypeIP, "", []ViolationRequest{
+		{Object: "192.168.0.1", Violation: "violation1", Tags: []string{"fxa", "amo"},
+			Metadata: map[string]string{"ticket": "5678", "campaign": "spring"}},
+		{Object: "10.0.0.1", Violation: "violation1", Tags: []string{"amo"}},
+		{Object: "192.168.0.2", Violation: "violation1", Tags: []string{""}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, ViolationStatusInvalidObject, results[2].Status)
+	r, err := repGet(TypeIP, "192.168.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"fxa", "credential-stuffing", "amo"}, r.Tags)
+	assert.Equal(t, map[string]string{"ticket": "5678", "campaign": "spring"}, r.Metadata)
+
+	tests := []struct {
+		Path string
+		Code int
+	}{
+		{"/type/ip/192.168.0.1", http.StatusOK},
+		{"/type/ip/192.168.0.1?tag=fxa", http.StatusOK},
+		{"/type/ip/192.168.0.1?tag=fxa&tag=amo", http.StatusOK},
+		{"/type/ip/192.168.0.1?tag=other", http.StatusNotFound},
+		{"/type/ip/192.168.0.1?tag=fxa&tag=other", http.StatusNotFound},
+	}
+	for _, tst := range tests {
+		recorder = httptest.NewRecorder()
+		req = httptest.NewRequest("GET", tst.Path, nil)
+		h.ServeHTTP(recorder, req)
+		assert.Equal(t, tst.Code, recorder.Code, tst.Path)
+	}
+
+	dumpTests := []struct {
+		Query   string
+		Objects []string
+	}{
+		{"", []string{"10.0.0.1", "192.168.0.1", "2001:db8:a0b:12f0::", "usr@mozilla.com"}},
+		{"?tag=amo", []string{"10.0.0.1", "192.168.0.1"}},
+		{"?tag=amo&tag=fxa", []string{"192.168.0.1"}},
+		{"?tag=other", []string{}},
+	}
+	for _, tst := range dumpTests {
+		recorder = httptest.NewRecorder()
+		req = httptest.NewRequest("GET", "/dump"+tst.Query, nil)
+		h.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var reps []Reputation
+		assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &reps))
+		objects := []string{}
+		for _, x := range reps {
+			objects = append(objects, x.Object)
+		}
+		sort.Strings(objects)
+		assert.Equal(t, tst.Objects, objects, tst.Query)
+	}
+
+	// Setting the reputation replaces the tags and metadata
+	recorder = httptest.NewRecorder()
+	buf = "{\"reputation\": 50, \"tags\": [\"manual\"]}"
+	req = httptest.NewRequest("PUT", "/type/ip/192.168.0.1", bytes.NewReader([]byte(buf)))
+	req.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	r, err = repGet(TypeIP, "192.168.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"manual"}, r.Tags)
+	assert.Nil(t, r.Metadata)
+}
+
+func TestReputationTagLimits(t *testing.T) {
+	assert.Nil(t, baseTest())
+	defer resetTestCfg()
+	sruntime.cfg.Auth.DisableAuth = true
+	sruntime.cfg.Tags.MaxTags = 2
+	sruntime.cfg.Tags.MaxTagLength = 8
+	sruntime.cfg.Tags.MaxMetadata = 2
+	sruntime.cfg.Tags.MaxMetadataLength = 8
+	h := mwHandler(newRouter())
+
+	results, err := applyViolationRequests(TypeIP, "", []ViolationRequest{
+		{Object: "192.168.0.1", Violation: "violation1", Tags: []string{"a", "b", "c"}},
+		{Object: "192.168.0.1", Violation: "violation1", Tags: []string{"toolongtag"}},
+		{Object: "192.168.0.1", Violation: "violation1",
+			Metadata: map[string]string{"a": "1", "b": "2", "c": "3"}},
+		{Object: "192.168.0.1", Violation: "violation1",
+			Metadata: map[string]string{"a": "toolongvalue"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, ViolationStatusInvalidObject, results[0].Status)
+	assert.Equal(t, "number of tags exceeds maximum of 2", results[0].Error)
+	assert.Equal(t, ViolationStatusInvalidObject, results[1].Status)
+	assert.Equal(t, "tag exceeds maximum length of 8", results[1].Error)
+	assert.Equal(t, ViolationStatusInvalidObject, results[2].Status)
+	assert.Equal(t, "number of metadata keys exceeds maximum of 2", results[2].Error)
+	assert.Equal(t, ViolationStatusInvalidObject, results[3].Status)
+	assert.Equal(t, "metadata exceeds maximum length of 8", results[3].Error)
+
+	// Violations still apply once the entry is at its limits, but new tags and
+	// metadata keys are not added
+	for _, vr := range []ViolationRequest{
+		{Object: "192.168.0.1", Violation: "violation1", Tags: []string{"a", "b"},
+			Metadata: map[string]string{"a": "1", "b": "2"}},
+		{Object: "192.168.0.1", Violation: "violation1", Tags: []string{"a", "c"},
+			Metadata: map[string]string{"b": "3", "c": "4"}},
+	} {
+		results, err = applyViolationRequests(TypeIP, "", []ViolationRequest{vr})
+		assert.Nil(t, err)
+		assert.Equal(t, ViolationStatusApplied, results[0].Status)
+	}
+	r, err := repGet(TypeIP, "192.168.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, r.Tags)
+	assert.Equal(t, map[string]string{"a": "1", "b": "3"}, r.Metadata)
+
+	recorder := httptest.NewRecorder()
+	buf := "{\"reputation\": 50, \"tags\": [\"a\", \"b\", \"c\"]}"
+	req := httptest.NewRequest("PUT", "/type/ip/192.168.0.1", bytes.NewReader([]byte(buf)))
+	req.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestPinnedReputation(t *testing.T) {
+	assert.Nil(t, baseTest())
+	sruntime.cfg.Auth.DisableAuth = true
+	h := mwHandler(newRouter())
+
+	tests := []struct {
+		Path string
+		Body string
+		Code int
+	}{
+		{"/type/ip/192.168.0.1/pin", "{\"reputation\": 10, \"reason\": \"known bad\"}", http.StatusOK},
+		{"/type/email/new@mozilla.com/pin", "{\"reputation\": 90}", http.StatusOK},
+		{"/type/ip/192.168.0.1/pin", "{\"reputation\": 101}", http.StatusBadRequest},
+		{"/type/ip/192.168.0.1/pin", "{\"reputation\": 10, \"expires\": \"2001-01-01T00:00:00Z\"}",
+			http.StatusBadRequest},
+		{"/type/ip/usr@mozilla.com/pin", "{\"reputation\": 10}", http.StatusBadRequest},
+	}
+	for _, tst := range tests {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("PUT", tst.Path, bytes.NewReader([]byte(tst.Body)))
+		req.Header.Set("Content-Type", "application/json")
+		h.ServeHTTP(recorder, req)
+		assert.Equal(t, tst.Code, recorder.Code, tst.Path)
+	}
+
+	r, err := repGet(TypeIP, "192.168.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, 10, r.Reputation)
+	assert.True(t, r.Pinned)
+	assert.Equal(t, "known bad", r.PinReason)
+	r, err = repGet(TypeEmail, "new@mozilla.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 90, r.Reputation)
+	assert.True(t, r.Pinned)
+
+	// Violations against pinned entries are recorded but don't change the score,
+	// and decay does not apply
+	sruntime.cfg.Decay.Points = 50
+	sruntime.cfg.Decay.Interval = time.Millisecond
+	results, err := applyViolationRequests(TypeIP, "", []ViolationRequest{
+		{Object: "192.168.0.1", Violation: "violation1"},
+		{Object: "192.168.0.2", Violation: "violation1"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, ViolationStatusPinned, results[0].Status)
+	assert.Equal(t, 10, results[0].Reputation.Reputation)
+	assert.Equal(t, ViolationStatusApplied, results[1].Status)
+	time.Sleep(time.Millisecond * 5)
+	r, err = repGet(TypeIP, "192.168.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, 10, r.Reputation)
+	hist, err := historyGet(TypeIP, "192.168.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(hist))
+	assert.Equal(t, 10, hist[0].Reputation)
+
+	// Once unpinned the entry decays as normal
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("DELETE", "/type/ip/192.168.0.1/pin", nil)
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	time.Sleep(time.Millisecond * 5)
+	r, err = repGet(TypeIP, "192.168.0.1")
+	assert.Nil(t, err)
+	assert.False(t, r.Pinned)
+	assert.Equal(t, 100, r.Reputation)
+
+	recorder = httptest.NewRecorder()
+	req = httptest.NewRequest("DELETE", "/type/ip/192.168.5.5/pin", nil)
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestSimulateViolations(t *testing.T) {
+	assert.Nil(t, baseTest())
+	sruntime.cfg.Auth.DisableAuth = true
+	h := mwHandler(newRouter())
+
+	recorder := httptest.NewRecorder()
+	buf := "[{\"object\": \"192.168.0.1\", \"violation\": \"violation1\"}, " +
+		"{\"object\": \"192.168.0.1\", \"violation\": \"violation1\"}, " +
+		"{\"object\": \"192.168.0.2\", \"violation\": \"violation2\"}, " +
+		"{\"object\": \"192.168.0.3\", \"violation\": \"unknown\"}, " +
+		"{\"object\": \"usr@mozilla.com\", \"violation\": \"violation1\"}]"
+	req := httptest.NewRequest("PUT", "/simulate/violations/type/ip", bytes.NewReader([]byte(buf)))
+	req.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var results []ViolationResult
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &results))
+	assert.Equal(t, 5, len(results))
+	assert.Equal(t, ViolationStatusApplied, results[0].Status)
+	assert.Equal(t, 45, results[0].Reputation.Reputation)
+	assert.Equal(t, ViolationStatusApplied, results[1].Status)
+	assert.Equal(t, 40, results[1].Reputation.Reputation)
+	assert.Equal(t, ViolationStatusApplied, results[2].Status)
+	assert.Equal(t, 50, results[2].Reputation.Reputation)
+	assert.Equal(t, ViolationStatusUnknownViolation, results[3].Status)
+	assert.Equal(t, ViolationStatusInvalidObject, results[4].Status)
+
+	// Nothing should have been written to the store
+	r, err := repGet(TypeIP, "192.168.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, 50, r.Reputation)
+	_, err = repGet(TypeIP, "192.168.0.2")
+	assert.Equal(t, ErrNotFound, err)
+	hist, err := historyGet(TypeIP, "192.168.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(hist))
+
+	// Simulated results include the band the reputation would fall in
+	sruntime.cfg.Bands.Default = []Band{{Name: "block", Min: 0, Max: 49, Action: "block"}}
+	defer func() {
+		sruntime.cfg.Bands.Default = nil
+	}()
+	results, err = simulateViolationRequests(TypeIP, "", []ViolationRequest{
+		{Object: "192.168.0.1", Violation: "violation1"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "block", results[0].Reputation.Band)
+}
+
+func TestViolationEventID(t *testing.T) {
+	assert.Nil(t, baseTest())
+	sruntime.cfg.Auth.DisableAuth = true
+	h := mwHandler(newRouter())
+
+	results, err := applyViolationRequests(TypeIP, "", []ViolationRequest{
+		{Object: "192.168.0.1", Violation: "violation1", EventID: "e1"},
+		{Object: "192.168.0.1", Violation: "violation1", EventID: "e1"},
+		{Object: "192.168.0.1", Violation: "violation1"},
+		{Object: "192.168.0.2", Violation: "violation1", EventID: "e1"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, ViolationStatusApplied, results[0].Status)
+	assert.Equal(t, ViolationStatusDuplicate, results[1].Status)
+	assert.Equal(t, 45, results[1].Reputation.Reputation)
+	assert.Equal(t, ViolationStatusApplied, results[2].Status)
+	assert.Equal(t, 40, results[2].Reputation.Reputation)
+	assert.Equal(t, ViolationStatusApplied, results[3].Status)
+
+	// Retrying the request should not apply the violation again
+	recorder := httptest.NewRecorder()
+	buf := "[{\"object\": \"192.168.0.1\", \"violation\": \"violation1\", \"event_id\": \"e1\"}, " +
+		"{\"object\": \"192.168.0.1\", \"violation\": \"violation1\", \"event_id\": \"e2\"}]"
+	req := httptest.NewRequest("PUT", "/violations/type/ip", bytes.NewReader([]byte(buf)))
+	req.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &results))
+	assert.Equal(t, ViolationStatusDuplicate, results[0].Status)
+	assert.Equal(t, ViolationStatusApplied, results[1].Status)
+	assert.Equal(t, 35, results[1].Reputation.Reputation)
+
+	recorder = httptest.NewRecorder()
+	buf = "{\"object\": \"192.168.0.1\", \"violation\": \"violation1\", \"event_id\": \"e2\"}"
+	req = httptest.NewRequest("PUT", "/violations/type/ip/192.168.0.1", bytes.NewReader([]byte(buf)))
+	req.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	r, err := repGet(TypeIP, "192.168.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, 35, r.Reputation)
+	hist, err := historyGet(TypeIP, "192.168.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(hist))
+
+	// Once the window has passed the event ID can be applied again
+	sruntime.cfg.Idempotency.Window = time.Millisecond
+	defer func() {
+		sruntime.cfg.Idempotency.Window = time.Hour * 24
+	}()
+	time.Sleep(time.Millisecond * 5)
+	results, err = applyViolationRequests(TypeIP, "", []ViolationRequest{
+		{Object: "192.168.0.1", Violation: "violation1", EventID: "e1"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, ViolationStatusApplied, results[0].Status)
+	assert.Equal(t, 30, results[0].Reputation.Reputation)
+	assert.Equal(t, map[string]time.Time{"e1": results[0].Reputation.Events["e1"]}, results[0].Reputation.Events)
+}
+
+func TestViolationBookkeeping(t *testing.T) {
+	assert.Nil(t, baseTest())
+	origDisableAuth := sruntime.cfg.Auth.DisableAuth
+	origMaxEvents := sruntime.cfg.Idempotency.MaxEvents
+	sruntime.cfg.Auth.DisableAuth = true
+	sruntime.cfg.Idempotency.MaxEvents = 3
+	defer func() {
+		sruntime.cfg.Auth.DisableAuth = origDisableAuth
+		sruntime.cfg.Idempotency.MaxEvents = origMaxEvents
+	}()
+	h := mwHandler(newRouter())
+
+	// Only the most recent event IDs are kept
+	for i := 1; i <= 5; i++ {
+		_, err := applyViolationRequests(TypeIP, "", []ViolationRequest{
+			{Object: "192.168.60.1", Violation: "violation3", EventID: fmt.Sprintf("e%v", i)},
+		})
+		assert.Nil(t, err)
+	}
+	r, err := repGet(TypeIP, "192.168.60.1")
+	assert.Nil(t, err)
+	var ids []string
+	for k := range r.Events {
+		ids = append(ids, k)
+	}
+	sort.Strings(ids)
+	assert.Equal(t, []string{"e3", "e4", "e5"}, ids)
+
+	// The bookkeeping should not be included in lookups
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/type/ip/192.168.60.1", nil)
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NotContains(t, recorder.Body.String(), "events")
+	assert.NotContains(t, recorder.Body.String(), "e5")
+
+	// Bookkeeping included in a PUT is ignored, and the bookkeeping of the
+	// existing entry is kept
+	recorder = httptest.NewRecorder()
+	req = httptest.NewRequest("PUT", "/type/ip/192.168.60.1",
+		bytes.NewReader([]byte(`{"reputation":80,"events":{"x1":"2030-01-01T00:00:00Z"},`+
+			`"sources":{"a":"2030-01-01T00:00:00Z"}}`)))
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	r, err = repGet(TypeIP, "192.168.60.1")
+	assert.Nil(t, err)
+	assert.Equal(t, 80, r.Reputation)
+	assert.Nil(t, r.Sources)
+	ids = ids[:0]
+	for k := range r.Events {
+		ids = append(ids, k)
+	}
+	sort.Strings(ids)
+	assert.Equal(t, []string{"e3", "e4", "e5"}, ids)
+	results, err := applyViolationRequests(TypeIP, "", []ViolationRequest{
+		{Object: "192.168.60.1", Violation: "violation1", EventID: "e5"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, ViolationStatusDuplicate, results[0].Status)
+
+	// A PUT for a new object stores no bookkeeping
+	recorder = httptest.NewRecorder()
+	req = httptest.NewRequest("PUT", "/type/ip/192.168.60.2",
+		bytes.NewReader([]byte(`{"reputation":80,"events":{"x1":"2030-01-01T00:00:00Z"}}`)))
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	buf, err := sruntime.store.Get("ip 192.168.60.2")
+	assert.Nil(t, err)
+	assert.NotContains(t, string(buf), "events")
+}
+
+func TestCustomTypes(t *testing.T) {
+	assert.Nil(t, baseTest())
+	sruntime.cfg.Auth.DisableAuth = true
+	h := mwHandler(newRouter())
+
+	unregisterTypes(t, "device", "network")
+	assert.Nil(t, RegisterTypes(map[string]TypeConfig{
+		"device":  {Validator: "uuid", Normalize: []string{"lowercase"}},
+		"network": {Validator: "cidr"},
+	}))
+
+	tests := []struct {
+		Method string
+		Path   string
+		Body   string
+		Code   int
+	}{
+		{"PUT", "/violations/type/device/F47AC10B-58CC-4372-A567-0E02B2C3D479",
+			"{\"violation\": \"violation1\"}", http.StatusOK},
+		{"GET", "/type/device/f47ac10b-58cc-4372-a567-0e02b2c3d479", "", http.StatusOK},
+		{"GET", "/type/device/F47AC10B-58CC-4372-A567-0E02B2C3D479", "", http.StatusOK},
+		{"GET", "/type/device/not-a-uuid", "", http.StatusBadRequest},
+		{"PUT", "/violations/type/network/10.0.0.0%2F8", "{\"violation\": \"violation1\"}", http.StatusOK},
+		{"GET", "/type/network/10.0.0.0%2F8", "", http.StatusOK},
+		{"PUT", "/violations/type/network/10.0.0.1%2F8", "{\"violation\": \"violation1\"}", http.StatusOK},
+		{"GET", "/type/network/10.0.0.0", "", http.StatusBadRequest},
+		{"GET", "/type/unknown/10.0.0.0", "", http.StatusBadRequest},
+	}
+	for _, tst := range tests {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(tst.Method, tst.Path, bytes.NewReader([]byte(tst.Body)))
+		req.Header.Set("Content-Type", "application/json")
+		h.ServeHTTP(recorder, req)
+		assert.Equal(t, tst.Code, recorder.Code, tst.Path)
+	}
+
+	r, err := repGet("device", "f47ac10b-58cc-4372-a567-0e02b2c3d479")
+	assert.Nil(t, err)
+	assert.Equal(t, "f47ac10b-58cc-4372-a567-0e02b2c3d479", r.Object)
+	assert.Equal(t, 95, r.Reputation)
+	// Both violations should have been applied to the canonical form of the network
+	r, err = repGet("network", "10.0.0.1/8")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.0/8", r.Object)
+	assert.Equal(t, 90, r.Reputation)
+}
+
 func TestHandlersLegacy(t *testing.T) {
 	mockStats := newMockStatsClient()
 	assert.Nil(t, baseTest())
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -14,23 +15,51 @@ import (
 
 type serverRuntime struct {
 	cfg              ServerCfg
-	redis            redisLink
+	store            Store
 	versionResponse  []byte
 	exceptionsLoaded chan bool
 	statsd           *statsdClient
 }
 
 type ServerCfg struct {
-	Listen string
-	Redis  struct {
-		Addr         string
-		Replicas     []string
+	Listen    string
+	Backend   string
+	KeyPrefix string
+	Redis     struct {
+		Mode     string
+		Addr     string
+		Replicas []string
+		Sentinel struct {
+			MasterName string
+			Addrs      []string
+			Username   string
+			Password   string
+		}
+		Cluster struct {
+			Addrs []string
+		}
+		ReadFromReplicas bool
+		Username         string
+		Password         string
+		DB               int
+		TLS              struct {
+			Enable             bool
+			CACert             string
+			Cert               string
+			Key                string
+			ServerName         string
+			InsecureSkipVerify bool
+		}
 		ReadTimeout  int
 		WriteTimeout int
 		DialTimeout  int
 		MaxPoolSize  int
 		MinIdleConn  int
 	}
+	Memory struct {
+		SnapshotFile     string
+		SnapshotInterval time.Duration
+	}
 	Auth struct {
 		DisableAuth bool
 		Hawk        map[string]string
@@ -38,11 +67,66 @@ type ServerCfg struct {
 		ROHawk      map[string]string
 		ROAPIKey    map[string]string
 	}
-	IP6Prefix  int
-	Violations []Violation
-	Decay      struct {
-		Points   int
-		Interval time.Duration
+	IP6Prefix      int
+	Types          map[string]TypeConfig
+	Email          EmailConfig
+	Violations     []Violation
+	TypeViolations map[string][]Violation
+	Decay          struct {
+		DecayConfig `yaml:",inline"`
+		Strategies  map[string]DecayConfig
+		Types       map[string]string
+	}
+	Retention struct {
+		Default   time.Duration
+		Recovered time.Duration
+		Types     map[string]time.Duration
+	}
+	History struct {
+		Disable    bool
+		MaxEntries int
+	}
+	Tags struct {
+		MaxTags           int
+		MaxTagLength      int
+		MaxMetadata       int
+		MaxMetadataLength int
+	}
+	Idempotency struct {
+		Window    time.Duration
+		MaxEvents int
+	}
+	Budget struct {
+		PenaltyBudget `yaml:",inline"`
+		Types         map[string]PenaltyBudget
+	}
+	Reporters struct {
+		Weights       map[string]float64
+		Corroboration struct {
+			Sources int
+			Window  time.Duration
+			Weight  float64
+		}
+	}
+	Domain struct {
+		Enable       bool
+		MinAddresses int
+		MaxAddresses int
+		Exclude      []string
+
+		// excluded is the set of domains in Exclude, lowercased
+		excluded map[string]bool
+	}
+	Subnet struct {
+		Enable       bool
+		IP4Prefix    int
+		IP6Prefix    int
+		MinAddresses int
+		MaxAddresses int
+	}
+	Bands struct {
+		Default []Band
+		Types   map[string][]Band
 	}
 	Exceptions struct {
 		File []string
@@ -64,6 +148,39 @@ type ServerCfg struct {
 }
 
 func (cfg *ServerCfg) validate() error {
+	if cfg.Backend == "" {
+		cfg.Backend = BackendRedis
+	}
+	if cfg.Backend != BackendRedis && cfg.Backend != BackendMemory {
+		return fmt.Errorf("invalid backend %v", cfg.Backend)
+	}
+	if cfg.Redis.Mode == "" {
+		cfg.Redis.Mode = RedisModeStandalone
+	}
+	if cfg.Backend == BackendRedis {
+		switch cfg.Redis.Mode {
+		case RedisModeStandalone:
+		case RedisModeSentinel:
+			if cfg.Redis.Sentinel.MasterName == "" || len(cfg.Redis.Sentinel.Addrs) == 0 {
+				return fmt.Errorf("redis sentinel mode requires a master name and sentinel addresses")
+			}
+		case RedisModeCluster:
+			if len(cfg.Redis.Cluster.Addrs) == 0 {
+				return fmt.Errorf("redis cluster mode requires cluster addresses")
+			}
+			if cfg.Redis.DB != 0 {
+				return fmt.Errorf("redis cluster mode does not support db selection")
+			}
+		default:
+			return fmt.Errorf("invalid redis mode %v", cfg.Redis.Mode)
+		}
+	}
+	if cfg.Memory.SnapshotInterval == 0 {
+		cfg.Memory.SnapshotInterval = time.Minute
+	}
+	if cfg.Memory.SnapshotInterval < 0 {
+		return fmt.Errorf("invalid memory snapshot interval %v", cfg.Memory.SnapshotInterval)
+	}
 	if cfg.VersionResponse == "" {
 		cfg.VersionResponse = "./version.json"
 	}
@@ -82,10 +199,225 @@ func (cfg *ServerCfg) validate() error {
 	if cfg.IP6Prefix == 0 {
 		cfg.IP6Prefix = 64
 	}
+	if cfg.Retention.Default == 0 {
+		cfg.Retention.Default = defaultRetention
+	}
+	if cfg.Retention.Recovered == 0 {
+		cfg.Retention.Recovered = time.Hour
+	}
+	if cfg.Retention.Default < 0 || cfg.Retention.Recovered < 0 {
+		return fmt.Errorf("invalid retention configuration")
+	}
+	for k, v := range cfg.Types {
+		if k == TypeIP || k == TypeEmail {
+			return fmt.Errorf("can not replace built-in type %v", k)
+		}
+		_, err := newObjectType(k, v)
+		if err != nil {
+			return err
+		}
+	}
+	err := cfg.Email.validate()
+	if err != nil {
+		return err
+	}
+	err = cfg.Decay.DecayConfig.validate()
+	if err != nil {
+		return err
+	}
+	for k, v := range cfg.Decay.Strategies {
+		err = v.validate()
+		if err != nil {
+			return fmt.Errorf("decay strategy %v: %v", k, err)
+		}
+		cfg.Decay.Strategies[k] = v
+	}
+	for k, v := range cfg.Decay.Types {
+		if _, ok := cfg.Decay.Strategies[v]; !ok {
+			return fmt.Errorf("unknown decay strategy %v for type %v", v, k)
+		}
+	}
+	for _, v := range cfg.Violations {
+		err = cfg.validateViolation(v)
+		if err != nil {
+			return err
+		}
+	}
+	for k, vs := range cfg.TypeViolations {
+		if !cfg.hasType(k) {
+			return fmt.Errorf("violations configured for unknown type %v", k)
+		}
+		for _, v := range vs {
+			err = cfg.validateViolation(v)
+			if err != nil {
+				return fmt.Errorf("type %v: %v", k, err)
+			}
+		}
+	}
+	if cfg.Subnet.IP4Prefix == 0 {
+		cfg.Subnet.IP4Prefix = 24
+	}
+	if cfg.Subnet.IP6Prefix == 0 {
+		cfg.Subnet.IP6Prefix = 48
+	}
+	if cfg.Subnet.MinAddresses == 0 {
+		cfg.Subnet.MinAddresses = 3
+	}
+	if cfg.Subnet.MaxAddresses == 0 {
+		cfg.Subnet.MaxAddresses = 256
+	}
+	if cfg.Subnet.IP4Prefix < 0 || cfg.Subnet.IP4Prefix > 32 {
+		return fmt.Errorf("invalid subnet ip4prefix %v", cfg.Subnet.IP4Prefix)
+	}
+	// IPv6 addresses are already collapsed to the width indicated by IP6Prefix, so
+	// the network must be at least that wide
+	if cfg.Subnet.IP6Prefix < 0 || cfg.Subnet.IP6Prefix > cfg.IP6Prefix {
+		return fmt.Errorf("invalid subnet ip6prefix %v", cfg.Subnet.IP6Prefix)
+	}
+	if cfg.Subnet.MinAddresses < 0 || cfg.Subnet.MaxAddresses < 0 {
+		return fmt.Errorf("invalid subnet address limits")
+	}
+	if cfg.Domain.MinAddresses == 0 {
+		cfg.Domain.MinAddresses = 3
+	}
+	if cfg.Domain.MaxAddresses == 0 {
+		cfg.Domain.MaxAddresses = 100
+	}
+	if cfg.Domain.MinAddresses < 0 || cfg.Domain.MaxAddresses < 0 {
+		return fmt.Errorf("invalid domain address limits")
+	}
+	if cfg.Domain.Exclude == nil {
+		cfg.Domain.Exclude = defaultDomainExclude
+	}
+	cfg.Domain.excluded = make(map[string]bool, len(cfg.Domain.Exclude))
+	for _, x := range cfg.Domain.Exclude {
+		cfg.Domain.excluded[strings.ToLower(x)] = true
+	}
+	if cfg.History.MaxEntries == 0 {
+		cfg.History.MaxEntries = 100
+	}
+	if cfg.History.MaxEntries < 0 {
+		return fmt.Errorf("invalid history maxentries %v", cfg.History.MaxEntries)
+	}
+	if cfg.Tags.MaxTags == 0 {
+		cfg.Tags.MaxTags = 32
+	}
+	if cfg.Tags.MaxTagLength == 0 {
+		cfg.Tags.MaxTagLength = 128
+	}
+	if cfg.Tags.MaxMetadata == 0 {
+		cfg.Tags.MaxMetadata = 32
+	}
+	if cfg.Tags.MaxMetadataLength == 0 {
+		cfg.Tags.MaxMetadataLength = 1024
+	}
+	if cfg.Tags.MaxTags < 0 || cfg.Tags.MaxTagLength < 0 ||
+		cfg.Tags.MaxMetadata < 0 || cfg.Tags.MaxMetadataLength < 0 {
+		return fmt.Errorf("invalid tag limits")
+	}
+	if cfg.Idempotency.Window == 0 {
+		cfg.Idempotency.Window = time.Hour * 24
+	}
+	if cfg.Idempotency.Window < 0 {
+		return fmt.Errorf("invalid idempotency window %v", cfg.Idempotency.Window)
+	}
+	if cfg.Idempotency.MaxEvents == 0 {
+		cfg.Idempotency.MaxEvents = 100
+	}
+	if cfg.Idempotency.MaxEvents < 0 {
+		return fmt.Errorf("invalid idempotency maxevents %v", cfg.Idempotency.MaxEvents)
+	}
+	err = cfg.validateReporters()
+	if err != nil {
+		return err
+	}
+	err = cfg.Budget.PenaltyBudget.validate()
+	if err != nil {
+		return err
+	}
+	for k, v := range cfg.Budget.Types {
+		if !cfg.hasType(k) {
+			return fmt.Errorf("budget configured for unknown type %v", k)
+		}
+		err = v.validate()
+		if err != nil {
+			return fmt.Errorf("type %v: %v", k, err)
+		}
+	}
+	for k, v := range cfg.Retention.Types {
+		if v <= 0 {
+			return fmt.Errorf("invalid retention for type %v", k)
+		}
+	}
+	err = validateBands(cfg.Bands.Default)
+	if err != nil {
+		return err
+	}
+	for k, v := range cfg.Bands.Types {
+		if !cfg.hasType(k) {
+			return fmt.Errorf("bands configured for unknown type %v", k)
+		}
+		err = validateBands(v)
+		if err != nil {
+			return fmt.Errorf("type %v: %v", k, err)
+		}
+	}
 	return nil
 }
 
-func (cfg *ServerCfg) getViolation(v string) *Violation {
+// hasType returns true if typestr is a built-in or registered object type, or a
+// custom type in the configuration
+func (cfg *ServerCfg) hasType(typestr string) bool {
+	if _, ok := cfg.Types[typestr]; ok {
+		return true
+	}
+	return isValidType(typestr)
+}
+
+// defaultRetention is the retention period for reputation entries if one is not
+// configured
+const defaultRetention = time.Hour * 336
+
+// retention returns the retention period for reputation entries of type typestr
+func (cfg *ServerCfg) retention(typestr string) time.Duration {
+	if v, ok := cfg.Retention.Types[typestr]; ok {
+		return v
+	}
+	return cfg.Retention.Default
+}
+
+func (cfg *ServerCfg) validateViolation(v Violation) error {
+	if v.Decay != "" {
+		if _, ok := cfg.Decay.Strategies[v.Decay]; !ok {
+			return fmt.Errorf("unknown decay strategy %v for violation %v", v.Decay, v.Name)
+		}
+	}
+	if v.Escalation == nil {
+		return nil
+	}
+	if v.Escalation.Window <= 0 {
+		return fmt.Errorf("violation %v escalation requires a window", v.Name)
+	}
+	if v.Escalation.Multiplier < 0 || v.Escalation.SuppressRecovery < 0 {
+		return fmt.Errorf("invalid escalation for violation %v", v.Name)
+	}
+	for _, x := range v.Escalation.Steps {
+		if x < 0 || x > 100 {
+			return fmt.Errorf("invalid escalation step penalty %v for violation %v", x, v.Name)
+		}
+	}
+	return nil
+}
+
+// getViolation returns the configuration for violation v applied to an object of
+// type typestr. Violations configured for the type take precedence over the
+// global violations.
+func (cfg *ServerCfg) getViolation(typestr string, v string) *Violation {
+	for _, x := range cfg.TypeViolations[typestr] {
+		if x.Name == v {
+			return &x
+		}
+	}
 	for _, x := range cfg.Violations {
 		if x.Name == v {
 			return &x
@@ -94,6 +426,26 @@ func (cfg *ServerCfg) getViolation(v string) *Violation {
 	return nil
 }
 
+// typeViolations returns the violations that apply to objects of type typestr,
+// which are the violations configured for the type along with any global
+// violations that are not overridden by the type
+func (cfg *ServerCfg) typeViolations(typestr string) []Violation {
+	ret := append([]Violation{}, cfg.TypeViolations[typestr]...)
+	for _, x := range cfg.Violations {
+		found := false
+		for _, y := range cfg.TypeViolations[typestr] {
+			if x.Name == y.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ret = append(ret, x)
+		}
+	}
+	return ret
+}
+
 var sruntime serverRuntime
 
 func init() {
@@ -129,11 +481,15 @@ func CreateServerRuntime(confpath string) {
 	if err != nil {
 		log.Fatalf(err.Error())
 	}
+	err = RegisterTypes(sruntime.cfg.Types)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
 	sruntime.statsd, err = newStatsdClient(sruntime.cfg)
 	if err != nil {
 		log.Fatalf(err.Error())
 	}
-	sruntime.redis, err = newRedisLink(sruntime.cfg)
+	sruntime.store, err = newStore(sruntime.cfg)
 	if err != nil {
 		log.Fatalf(err.Error())
 	}
@@ -160,4 +516,10 @@ func StartDaemon(confpath string) {
 	if err != nil {
 		log.Fatalf(err.Error())
 	}
+	// Close the store once the API has stopped, so the memory backend can write
+	// a final snapshot
+	err = sruntime.store.Close()
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
 }
@@ -36,8 +36,49 @@ func (m *mockStatsClient) Incr(name string, tags []string, rate float64) error {
 	return nil
 }
 
+// flushStore removes all keys from the store in use by the tests
+func flushStore() error {
+	var (
+		cursor uint64
+		keys   []string
+	)
+	for {
+		k, next, err := sruntime.store.Scan(cursor, "*", 1000)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, k...)
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return sruntime.store.Delete(keys...)
+}
+
+// testCfg holds the validated default configuration the tests are run with
+var testCfg ServerCfg
+
+// resetTestCfg restores the configuration sections that tests commonly modify to
+// their defaults, so state left by one test doesn't affect the next
+func resetTestCfg() {
+	sruntime.cfg.Retention = testCfg.Retention
+	sruntime.cfg.History = testCfg.History
+	sruntime.cfg.Tags = testCfg.Tags
+	sruntime.cfg.Subnet = testCfg.Subnet
+	sruntime.cfg.Domain = testCfg.Domain
+	sruntime.cfg.Idempotency = testCfg.Idempotency
+	sruntime.cfg.Reporters = testCfg.Reporters
+	sruntime.cfg.Budget = testCfg.Budget
+	sruntime.cfg.Email = testCfg.Email
+}
+
 func baseTest() error {
-	_, err := sruntime.redis.flushAll().Result()
+	resetTestCfg()
+	err := flushStore()
 	if err != nil {
 		return err
 	}
@@ -102,22 +143,26 @@ func TestMain(m *testing.M) {
 		err  error
 		tcfg ServerCfg
 	)
-	tcfg.Redis.Addr = "127.0.0.1:6379"
+	// Run the tests against Redis if an address has been provided, otherwise
+	// use the memory store
+	tcfg.Backend = BackendMemory
+	tcfg.KeyPrefix = "iprepd-test:"
+	renv := os.Getenv("IPREPD_TEST_REDISADDR")
+	if renv != "" {
+		tcfg.Backend = BackendRedis
+		tcfg.Redis.Addr = renv
+	}
 	err = tcfg.validate()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
-	renv := os.Getenv("IPREPD_TEST_REDISADDR")
-	if renv != "" {
-		tcfg.Redis.Addr = renv
-	}
 	sruntime.statsd, err = newStatsdClient(tcfg)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
-	sruntime.redis, err = newRedisLink(tcfg)
+	sruntime.store, err = newStore(tcfg)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
@@ -131,11 +176,13 @@ func TestMain(m *testing.M) {
 	sruntime.cfg.Decay.Points = 0
 	sruntime.cfg.Decay.Interval = time.Minute
 	sruntime.cfg.Violations = []Violation{
-		{"violation1", 5, 25},
-		{"violation2", 50, 50},
-		{"violation3", 0, 0},
+		{Name: "violation1", Penalty: 5, DecreaseLimit: 25},
+		{Name: "violation2", Penalty: 50, DecreaseLimit: 50},
+		{Name: "violation3", Penalty: 0, DecreaseLimit: 0},
 	}
 	sruntime.cfg.IP6Prefix = 64
+	testCfg = tcfg
+	resetTestCfg()
 	loadExceptions()
 	os.Exit(m.Run())
 }
@@ -0,0 +1,360 @@
+package iprepd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// memoryEntry is a value stored in a memoryStore
+type memoryEntry struct {
+	Value   []byte    `json:"value"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// memoryStore is an in-process Store, suitable for single node deployments and
+// testing. If a snapshot file is configured the contents of the store are
+// periodically written to disk, and loaded again when the store is created. A
+// final snapshot is written when the store is closed.
+type memoryStore struct {
+	sync.Mutex
+	entries      map[string]memoryEntry
+	snapshotFile string
+
+	// order holds every key in the store at a fixed position, which is used as
+	// the cursor for scans. Deleted keys leave an empty slot that is recorded in
+	// free and reused for a later key, so keys never move while they are in the
+	// store. pos maps each key to its position in order.
+	order []string
+	pos   map[string]int
+	free  []int
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func newMemoryStore(cfg ServerCfg) (ret *memoryStore, err error) {
+	if cfg.Memory.SnapshotInterval <= 0 {
+		return nil, fmt.Errorf("invalid memory snapshot interval %v", cfg.Memory.SnapshotInterval)
+	}
+	ret = &memoryStore{
+		entries:      make(map[string]memoryEntry),
+		snapshotFile: cfg.Memory.SnapshotFile,
+		pos:          make(map[string]int),
+		done:         make(chan struct{}),
+	}
+	if ret.snapshotFile != "" {
+		err = ret.loadSnapshot()
+		if err != nil {
+			return nil, err
+		}
+	}
+	ret.wg.Add(1)
+	go ret.maintain(cfg.Memory.SnapshotInterval)
+	return
+}
+
+// maintain periodically removes expired entries from the store, and writes a
+// snapshot if configured to do so, until the store is closed
+func (m *memoryStore) maintain(interval time.Duration) {
+	defer m.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-t.C:
+		}
+		m.expire()
+		if m.snapshotFile == "" {
+			continue
+		}
+		err := m.saveSnapshot()
+		if err != nil {
+			log.Errorf("memory store snapshot failed: %s", err)
+		}
+	}
+}
+
+// Close stops the periodic maintenance of the store, and writes a final snapshot
+// if configured to do so
+func (m *memoryStore) Close() (err error) {
+	m.closeOnce.Do(func() {
+		close(m.done)
+		m.wg.Wait()
+		if m.snapshotFile != "" {
+			err = m.saveSnapshot()
+		}
+	})
+	return
+}
+
+// put stores entry e for key k, adding the key to the scan order if it is new.
+// The caller must hold the lock.
+func (m *memoryStore) put(k string, e memoryEntry) {
+	if _, ok := m.entries[k]; !ok {
+		if n := len(m.free); n > 0 {
+			m.pos[k] = m.free[n-1]
+			m.order[m.free[n-1]] = k
+			m.free = m.free[:n-1]
+		} else {
+			m.pos[k] = len(m.order)
+			m.order = append(m.order, k)
+		}
+	}
+	m.entries[k] = e
+}
+
+// remove deletes key k from the store. The caller must hold the lock.
+func (m *memoryStore) remove(k string) {
+	i, ok := m.pos[k]
+	if !ok {
+		return
+	}
+	delete(m.entries, k)
+	delete(m.pos, k)
+	m.order[i] = ""
+	m.free = append(m.free, i)
+}
+
+func (m *memoryStore) expire() {
+	now := time.Now()
+	m.Lock()
+	defer m.Unlock()
+	for k, e := range m.entries {
+		if e.expired(now) {
+			m.remove(k)
+		}
+	}
+}
+
+func (m *memoryStore) loadSnapshot() error {
+	buf, err := ioutil.ReadFile(m.snapshotFile)
+	if err != nil {
+		// A missing snapshot is expected the first time the store is used
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	entries := make(map[string]memoryEntry)
+	err = json.Unmarshal(buf, &entries)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	m.entries = make(map[string]memoryEntry, len(entries))
+	m.order = nil
+	m.pos = make(map[string]int, len(entries))
+	m.free = nil
+	for k, e := range entries {
+		m.put(k, e)
+	}
+	m.Unlock()
+	m.expire()
+	log.Infof("loaded %v entries from memory store snapshot %v", len(entries), m.snapshotFile)
+	return nil
+}
+
+func (m *memoryStore) saveSnapshot() error {
+	m.Lock()
+	buf, err := json.Marshal(m.entries)
+	m.Unlock()
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file in the same directory and rename it over the
+	// snapshot, so a partially written snapshot is never loaded
+	fd, err := ioutil.TempFile(filepath.Dir(m.snapshotFile), ".iprepd-snapshot")
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(buf)
+	if err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		return err
+	}
+	err = fd.Close()
+	if err != nil {
+		os.Remove(fd.Name())
+		return err
+	}
+	return os.Rename(fd.Name(), m.snapshotFile)
+}
+
+func (m *memoryStore) Get(k string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	e, ok := m.entries[k]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if e.expired(time.Now()) {
+		m.remove(k)
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), e.Value...), nil
+}
+
+func (m *memoryStore) MGet(k ...string) ([][]byte, error) {
+	ret := make([][]byte, len(k))
+	for i, x := range k {
+		buf, err := m.Get(x)
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		ret[i] = buf
+	}
+	return ret, nil
+}
+
+func (m *memoryStore) Set(k string, v []byte, e time.Duration) error {
+	ent := memoryEntry{Value: append([]byte(nil), v...)}
+	if e > 0 {
+		ent.Expires = time.Now().Add(e)
+	}
+	m.Lock()
+	m.put(k, ent)
+	m.Unlock()
+	return nil
+}
+
+func (m *memoryStore) Update(k []string, fn func(int, []byte) (StoreValue, error)) error {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	nv := make([]StoreValue, len(k))
+	for i, x := range k {
+		var cur []byte
+		if ent, ok := m.entries[x]; ok && !ent.expired(now) {
+			cur = append([]byte(nil), ent.Value...)
+		}
+		v, err := fn(i, cur)
+		if err != nil {
+			return err
+		}
+		nv[i] = v
+	}
+	for i, v := range nv {
+		if v.Value == nil {
+			continue
+		}
+		ent := memoryEntry{Value: append([]byte(nil), v.Value...)}
+		if v.Expiry > 0 {
+			ent.Expires = now.Add(v.Expiry)
+		}
+		m.put(k[i], ent)
+	}
+	return nil
+}
+
+func (m *memoryStore) Delete(k ...string) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, x := range k {
+		m.remove(x)
+	}
+	return nil
+}
+
+// Scan examines count keys from the position indicated by the cursor, and returns
+// those that match. As with Redis, a batch may contain fewer than count keys, or
+// none at all, before iteration is complete. Keys remain at the same position
+// while they are in the store, so a key present for the duration of a scan is
+// returned exactly once; keys added or removed during a scan may or may not be
+// returned.
+func (m *memoryStore) Scan(cursor uint64, match string, count int64) ([]string, uint64, error) {
+	if count <= 0 {
+		count = 10
+	}
+	now := time.Now()
+	m.Lock()
+	defer m.Unlock()
+	keys := make([]string, 0)
+	end := cursor + uint64(count)
+	if end > uint64(len(m.order)) {
+		end = uint64(len(m.order))
+	}
+	for i := cursor; i < end; i++ {
+		k := m.order[i]
+		if k == "" {
+			continue
+		}
+		if e := m.entries[k]; e.expired(now) || !globMatch(match, k) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	if end >= uint64(len(m.order)) {
+		end = 0
+	}
+	return keys, end, nil
+}
+
+func (m *memoryStore) TTL(k string) (time.Duration, error) {
+	m.Lock()
+	defer m.Unlock()
+	e, ok := m.entries[k]
+	if !ok || e.expired(time.Now()) {
+		return 0, ErrNotFound
+	}
+	if e.Expires.IsZero() {
+		return 0, nil
+	}
+	return time.Until(e.Expires), nil
+}
+
+func (m *memoryStore) Ping() error {
+	return nil
+}
+
+// globMatch reports whether s matches the Redis style glob pattern, supporting
+// the * and ? wildcards and \ to escape a character
+func globMatch(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,182 @@
+package iprepd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMemoryStore(t *testing.T, snapshotFile string) *memoryStore {
+	var cfg ServerCfg
+	cfg.Backend = BackendMemory
+	cfg.Memory.SnapshotFile = snapshotFile
+	cfg.Memory.SnapshotInterval = time.Hour
+	m, err := newMemoryStore(cfg)
+	assert.Nil(t, err)
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestMemoryStore(t *testing.T) {
+	m := newTestMemoryStore(t, "")
+
+	_, err := m.Get("ip 10.0.0.1")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = m.TTL("ip 10.0.0.1")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Nil(t, m.Set("ip 10.0.0.1", []byte("a"), 0))
+	assert.Nil(t, m.Set("ip 10.0.0.2", []byte("b"), time.Hour))
+	assert.Nil(t, m.Set("email usr@mozilla.com", []byte("c"), time.Millisecond))
+
+	buf, err := m.Get("ip 10.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), buf)
+	ttl, err := m.TTL("ip 10.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), ttl)
+	ttl, err = m.TTL("ip 10.0.0.2")
+	assert.Nil(t, err)
+	assert.InDelta(t, float64(time.Hour), float64(ttl), float64(time.Second))
+
+	// expired entries should no longer be returned
+	time.Sleep(time.Millisecond * 5)
+	_, err = m.Get("email usr@mozilla.com")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Nil(t, m.Delete("ip 10.0.0.2", "ip 10.0.0.3"))
+	_, err = m.Get("ip 10.0.0.2")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestMemoryStoreScan(t *testing.T) {
+	m := newTestMemoryStore(t, "")
+	assert.Nil(t, m.Set("ip 10.0.0.1", []byte("a"), 0))
+	assert.Nil(t, m.Set("ip 10.0.0.2", []byte("a"), 0))
+	assert.Nil(t, m.Set("ip 10.0.0.3", []byte("a"), 0))
+	assert.Nil(t, m.Set("email usr@mozilla.com", []byte("a"), 0))
+
+	var (
+		cursor uint64
+		keys   []string
+	)
+	for {
+		k, next, err := m.Scan(cursor, "ip *", 2)
+		assert.Nil(t, err)
+		assert.True(t, len(k) <= 2)
+		keys = append(keys, k...)
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, []string{"ip 10.0.0.1", "ip 10.0.0.2", "ip 10.0.0.3"}, keys)
+
+	keys, cursor, err := m.Scan(0, "*", 100)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), cursor)
+	assert.Equal(t, 4, len(keys))
+
+	// Keys that remain in the store for the duration of a scan should be returned
+	// exactly once, regardless of other keys being added and removed
+	k, cursor, err := m.Scan(0, "*", 2)
+	assert.Nil(t, err)
+	assert.Nil(t, m.Delete(k[0]))
+	assert.Nil(t, m.Set("ip 10.0.0.4", []byte("a"), 0))
+	assert.Nil(t, m.Set("ip 10.0.0.5", []byte("a"), 0))
+	keys = k
+	for cursor != 0 {
+		k, cursor, err = m.Scan(cursor, "*", 2)
+		assert.Nil(t, err)
+		keys = append(keys, k...)
+	}
+	counts := make(map[string]int)
+	for _, x := range keys {
+		counts[x]++
+	}
+	for _, x := range []string{"ip 10.0.0.2", "ip 10.0.0.3", "email usr@mozilla.com"} {
+		assert.Equal(t, 1, counts[x], x)
+	}
+}
+
+func TestMemoryStoreSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iprepd")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "snapshot")
+
+	m := newTestMemoryStore(t, fname)
+	assert.Nil(t, m.Set("ip 10.0.0.1", []byte("a"), 0))
+	assert.Nil(t, m.Set("ip 10.0.0.2", []byte("b"), time.Hour))
+	assert.Nil(t, m.Set("ip 10.0.0.3", []byte("c"), time.Millisecond))
+	time.Sleep(time.Millisecond * 5)
+	assert.Nil(t, m.saveSnapshot())
+
+	m = newTestMemoryStore(t, fname)
+	buf, err := m.Get("ip 10.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), buf)
+	buf, err = m.Get("ip 10.0.0.2")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("b"), buf)
+	ttl, err := m.TTL("ip 10.0.0.2")
+	assert.Nil(t, err)
+	assert.True(t, ttl > 0 && ttl <= time.Hour)
+	_, err = m.Get("ip 10.0.0.3")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestMemoryStoreClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iprepd")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "snapshot")
+
+	// Closing the store should write a final snapshot, even though the snapshot
+	// interval has not passed
+	m := newTestMemoryStore(t, fname)
+	assert.Nil(t, m.Set("ip 10.0.0.1", []byte("a"), 0))
+	assert.Nil(t, m.Close())
+	assert.Nil(t, m.Close())
+
+	m = newTestMemoryStore(t, fname)
+	buf, err := m.Get("ip 10.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), buf)
+}
+
+func TestMemoryStoreInterval(t *testing.T) {
+	var cfg ServerCfg
+	cfg.Backend = BackendMemory
+	_, err := newMemoryStore(cfg)
+	assert.NotNil(t, err)
+
+	cfg.Memory.SnapshotInterval = -time.Second
+	assert.NotNil(t, cfg.validate())
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		Pattern string
+		Value   string
+		Match   bool
+	}{
+		{"*", "ip 10.0.0.1", true},
+		{"ip *", "ip 10.0.0.1", true},
+		{"ip *", "email usr@mozilla.com", false},
+		{"ip 10.0.0.?", "ip 10.0.0.1", true},
+		{"ip 10.0.0.?", "ip 10.0.0.10", false},
+		{"*@mozilla.com", "email usr@mozilla.com", true},
+		{"prod\\*", "prod*", true},
+		{"prod\\*", "prodx", false},
+		{"", "", true},
+		{"", "a", false},
+	}
+	for _, tst := range tests {
+		assert.Equal(t, tst.Match, globMatch(tst.Pattern, tst.Value), tst.Pattern+" "+tst.Value)
+	}
+}
@@ -2,37 +2,53 @@ package iprepd
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	log "github.com/sirupsen/logrus"
 )
 
-type redisLink struct {
-	master      *redis.Client
-	readClients []*redis.Client
-}
+const (
+	// RedisModeStandalone uses a single Redis master, optionally with a set of
+	// read replicas
+	RedisModeStandalone = "standalone"
 
-func (r *redisLink) keys(pattern string) *redis.StringSliceCmd {
-	return r.master.Keys(context.Background(), pattern)
-}
+	// RedisModeSentinel uses Redis Sentinel to discover the current master
+	RedisModeSentinel = "sentinel"
 
-func (r *redisLink) del(k ...string) *redis.IntCmd {
-	return r.master.Del(context.Background(), k...)
-}
+	// RedisModeCluster uses a Redis Cluster
+	RedisModeCluster = "cluster"
+)
+
+// redisLink is a Store backed by Redis. Depending on the configured mode, this is
+// either a single master with optional read replicas, a master discovered using
+// Redis Sentinel, or a Redis Cluster.
+type redisLink struct {
+	master      redis.UniversalClient
+	readClients []redis.UniversalClient
 
-func (r *redisLink) flushAll() *redis.StatusCmd {
-	return r.master.FlushAll(context.Background())
+	// cluster is set if we are connected to a Redis Cluster, in which case
+	// commands operating on multiple keys need to be split up by hash slot
+	cluster *redis.ClusterClient
 }
 
-func (r *redisLink) get(k string) (ret []byte, err error) {
+func (r *redisLink) Get(k string) (ret []byte, err error) {
 	p := rand.Perm(len(r.readClients))
 	for _, i := range p {
 		ret, err = r.readClients[i].Get(context.Background(), k).Bytes()
-		if err == nil || (err != nil && err == redis.Nil) {
+		if err == redis.Nil {
+			return nil, ErrNotFound
+		}
+		if err == nil {
 			return
 		}
 		log.Error(err.Error())
@@ -42,12 +58,354 @@ func (r *redisLink) get(k string) (ret []byte, err error) {
 	return
 }
 
-func (r *redisLink) ping() *redis.StatusCmd {
-	return r.master.Ping(context.Background())
+func (r *redisLink) MGet(k ...string) (ret [][]byte, err error) {
+	if r.cluster != nil {
+		return r.clusterMGet(k...)
+	}
+	var vals []interface{}
+	p := rand.Perm(len(r.readClients))
+	for _, i := range p {
+		vals, err = r.readClients[i].MGet(context.Background(), k...).Result()
+		if err == nil {
+			break
+		}
+		log.Error(err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	ret = make([][]byte, len(vals))
+	for i, v := range vals {
+		if s, ok := v.(string); ok {
+			ret[i] = []byte(s)
+		}
+	}
+	return ret, nil
+}
+
+// clusterMGet fetches multiple keys from a Redis Cluster. MGET requires all keys
+// to reside in the same hash slot, so a pipeline of GET commands is used instead,
+// which the cluster client splits up across the nodes.
+func (r *redisLink) clusterMGet(k ...string) ([][]byte, error) {
+	ctx := context.Background()
+	pipe := r.cluster.Pipeline()
+	cmds := make([]*redis.StringCmd, len(k))
+	for i, x := range k {
+		cmds[i] = pipe.Get(ctx, x)
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	ret := make([][]byte, len(k))
+	for i, c := range cmds {
+		buf, err := c.Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = buf
+	}
+	return ret, nil
 }
 
-func (r *redisLink) set(k string, v interface{}, e time.Duration) *redis.StatusCmd {
-	return r.master.Set(context.Background(), k, v, e)
+func (r *redisLink) Set(k string, v []byte, e time.Duration) error {
+	return r.master.Set(context.Background(), k, v, e).Err()
+}
+
+// redisUpdateRetries is the number of times an update transaction will be
+// attempted if a key is modified by another client during the update
+const redisUpdateRetries = 50
+
+// redisUpdateBatchSize is the maximum number of keys included in a single update
+// transaction. Larger updates are split into several transactions, so a write by
+// another client to one of the keys only causes the transaction containing that
+// key to be retried, rather than the entire update.
+const redisUpdateBatchSize = 100
+
+// redisUpdateConcurrency is the maximum number of update transactions that are run
+// at the same time. Each transaction needs a connection of its own while it is in
+// progress, since Redis tracks watched keys per connection.
+const redisUpdateConcurrency = 8
+
+// Update uses WATCH to detect concurrent modification of the keys, fetches the
+// current values with a single MGET, and applies the new values in a MULTI/EXEC
+// transaction. If the transaction fails because a key was modified, the update is
+// retried using the new values.
+//
+// The keys are split into groups of at most redisUpdateBatchSize keys, and a
+// transaction is run for each group. In a Redis Cluster a transaction can only
+// include keys in the same hash slot, so the keys are first grouped by slot. The
+// transactions are run concurrently, so the update takes a similar number of round
+// trips regardless of how many groups the keys are split into. Calls to fn are
+// serialized, so fn does not need to be safe for concurrent use.
+func (r *redisLink) Update(k []string, fn func(int, []byte) (StoreValue, error)) error {
+	var (
+		groups [][]int
+		slots  = make(map[int]int)
+	)
+	for i, x := range k {
+		s := 0
+		if r.cluster != nil {
+			s = clusterKeySlot(x)
+		}
+		g, ok := slots[s]
+		if !ok || len(groups[g]) == redisUpdateBatchSize {
+			g = len(groups)
+			slots[s] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+	var (
+		wg      sync.WaitGroup
+		fnLock  sync.Mutex
+		errLock sync.Mutex
+		err     error
+		sem     = make(chan struct{}, redisUpdateConcurrency)
+	)
+	lfn := func(i int, cur []byte) (StoreValue, error) {
+		fnLock.Lock()
+		defer fnLock.Unlock()
+		return fn(i, cur)
+	}
+	for _, g := range groups {
+		sem <- struct{}{}
+		errLock.Lock()
+		failed := err != nil
+		errLock.Unlock()
+		if failed {
+			<-sem
+			break
+		}
+		gk := make([]string, len(g))
+		for j, i := range g {
+			gk[j] = k[i]
+		}
+		wg.Add(1)
+		go func(gk []string, g []int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			e := r.updateKeys(gk, g, lfn)
+			if e != nil {
+				errLock.Lock()
+				if err == nil {
+					err = e
+				}
+				errLock.Unlock()
+			}
+		}(gk, g)
+	}
+	wg.Wait()
+	return err
+}
+
+// updateKeys runs an update transaction for keys k, where idx contains the index
+// of each key in the set of keys originally passed to Update
+func (r *redisLink) updateKeys(k []string, idx []int, fn func(int, []byte) (StoreValue, error)) error {
+	ctx := context.Background()
+	txf := func(tx *redis.Tx) error {
+		// Reads are made against the master here rather than the replicas, since
+		// the values need to be consistent with the watched keys
+		vals, err := tx.MGet(ctx, k...).Result()
+		if err != nil {
+			return err
+		}
+		nv := make([]StoreValue, len(k))
+		for i, v := range vals {
+			var cur []byte
+			if s, ok := v.(string); ok {
+				cur = []byte(s)
+			}
+			nv[i], err = fn(idx[i], cur)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, v := range nv {
+				if v.Value == nil {
+					continue
+				}
+				pipe.Set(ctx, k[i], v.Value, v.Expiry)
+			}
+			return nil
+		})
+		return err
+	}
+	for i := 0; i < redisUpdateRetries; i++ {
+		err := r.master.Watch(ctx, txf, k...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return fmt.Errorf("update of %v keys failed after %v attempts", len(k), redisUpdateRetries)
+}
+
+func (r *redisLink) Delete(k ...string) error {
+	ctx := context.Background()
+	if r.cluster == nil {
+		return r.master.Del(ctx, k...).Err()
+	}
+	// DEL with multiple keys requires all keys to be in the same hash slot in a
+	// cluster, so delete each key individually
+	_, err := r.cluster.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, x := range k {
+			pipe.Del(ctx, x)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *redisLink) Scan(cursor uint64, match string, count int64) ([]string, uint64, error) {
+	if r.cluster != nil {
+		return r.clusterScan(cursor, match, count)
+	}
+	return r.master.Scan(context.Background(), cursor, match, count).Result()
+}
+
+// The cursor returned from a scan of a Redis Cluster is made up of the cursor for
+// the node being scanned in the lowest clusterNodeShift bits, the index of that
+// node in the next 8 bits, and a checksum of the cluster topology in the highest
+// 16 bits.
+const (
+	clusterNodeShift     = 40
+	clusterTopologyShift = 48
+	clusterMaxNodes      = 1 << (clusterTopologyShift - clusterNodeShift)
+)
+
+// clusterScan scans each of the master nodes in a Redis Cluster in turn, since a
+// SCAN command only returns keys from the node it is sent to. If the set of
+// masters changes while a scan is in progress the node index in the cursor no
+// longer refers to the same node, so an error is returned rather than returning
+// an incomplete set of keys.
+func (r *redisLink) clusterScan(cursor uint64, match string, count int64) ([]string, uint64, error) {
+	nodes, err := r.clusterMasters()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(nodes) > clusterMaxNodes {
+		return nil, 0, fmt.Errorf("scan of cluster with %v masters not supported", len(nodes))
+	}
+	addrs := make([]string, len(nodes))
+	for i, x := range nodes {
+		addrs[i] = x.Options().Addr
+	}
+	topology := uint64(crc16(strings.Join(addrs, ",")))
+	if cursor != 0 && cursor>>clusterTopologyShift != topology {
+		return nil, 0, fmt.Errorf("cluster topology changed during scan")
+	}
+	n := cursor >> clusterNodeShift & (clusterMaxNodes - 1)
+	if n >= uint64(len(nodes)) {
+		return []string{}, 0, nil
+	}
+	keys, next, err := nodes[n].Scan(context.Background(),
+		cursor&(1<<clusterNodeShift-1), match, count).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	if next >= 1<<clusterNodeShift {
+		return nil, 0, fmt.Errorf("scan cursor %v from cluster node out of range", next)
+	}
+	if next == 0 {
+		// Finished with this node, move on to the next one if there is one
+		n++
+		if n >= uint64(len(nodes)) {
+			return keys, 0, nil
+		}
+	}
+	return keys, topology<<clusterTopologyShift | n<<clusterNodeShift | next, nil
+}
+
+// clusterMasters returns clients for each master in the cluster, ordered by
+// address so the ordering is consistent between calls
+func (r *redisLink) clusterMasters() ([]*redis.Client, error) {
+	var (
+		nodes []*redis.Client
+		lock  sync.Mutex
+	)
+	err := r.cluster.ForEachMaster(context.Background(), func(ctx context.Context, c *redis.Client) error {
+		lock.Lock()
+		nodes = append(nodes, c)
+		lock.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Options().Addr < nodes[j].Options().Addr
+	})
+	return nodes, nil
+}
+
+func (r *redisLink) TTL(k string) (time.Duration, error) {
+	d, err := r.master.TTL(context.Background(), k).Result()
+	if err != nil {
+		return 0, err
+	}
+	// Redis returns -2 if the key does not exist, and -1 if the key exists but
+	// has no associated expiry
+	switch d {
+	case -2:
+		return 0, ErrNotFound
+	case -1:
+		return 0, nil
+	}
+	return d, nil
+}
+
+func (r *redisLink) Ping() error {
+	return r.master.Ping(context.Background()).Err()
+}
+
+func (r *redisLink) Close() error {
+	var err error
+	for _, c := range r.readClients {
+		// The master is also included in the read clients, and is closed last
+		if c == r.master {
+			continue
+		}
+		if e := c.Close(); e != nil {
+			err = e
+		}
+	}
+	if e := r.master.Close(); e != nil {
+		err = e
+	}
+	return err
+}
+
+// clusterKeySlot returns the Redis Cluster hash slot for key k. If the key
+// contains a hash tag, only the tag is hashed.
+func clusterKeySlot(k string) int {
+	if s := strings.IndexByte(k, '{'); s > -1 {
+		if e := strings.IndexByte(k[s+1:], '}'); e > 0 {
+			k = k[s+1 : s+e+1]
+		}
+	}
+	return int(crc16(k) % 16384)
+}
+
+// crc16 implements the CRC16-CCITT (XMODEM) checksum used by Redis Cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
 }
 
 type redisTimingHook struct{}
@@ -69,45 +427,138 @@ func (rth redisTimingHook) AfterProcessPipeline(ctx context.Context, cmds []redi
 	return nil
 }
 
-func newRedisLink(cfg ServerCfg) (ret redisLink, err error) {
+// redisTLSConfig returns the TLS configuration to use for Redis connections, or nil
+// if TLS is not enabled
+func redisTLSConfig(cfg ServerCfg) (*tls.Config, error) {
+	if !cfg.Redis.TLS.Enable {
+		return nil, nil
+	}
+	ret := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.Redis.TLS.ServerName,
+		InsecureSkipVerify: cfg.Redis.TLS.InsecureSkipVerify,
+	}
+	if cfg.Redis.TLS.CACert != "" {
+		buf, err := ioutil.ReadFile(cfg.Redis.TLS.CACert)
+		if err != nil {
+			return nil, err
+		}
+		ret.RootCAs = x509.NewCertPool()
+		if !ret.RootCAs.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no certificates found in %v", cfg.Redis.TLS.CACert)
+		}
+	}
+	if cfg.Redis.TLS.Cert != "" || cfg.Redis.TLS.Key != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Redis.TLS.Cert, cfg.Redis.TLS.Key)
+		if err != nil {
+			return nil, err
+		}
+		ret.Certificates = []tls.Certificate{cert}
+	}
+	return ret, nil
+}
+
+func newRedisLink(cfg ServerCfg) (ret *redisLink, err error) {
 	minIdleConns := cfg.Redis.MinIdleConn
+	ret = &redisLink{}
+	tlsConfig, err := redisTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
 	if cfg.Redis.MaxPoolSize != 0 && cfg.Redis.MaxPoolSize < 20 {
 		minIdleConns = cfg.Redis.MaxPoolSize
 	} else if cfg.Redis.MaxPoolSize == 0 && (10*runtime.NumCPU()) < 20 {
 		minIdleConns = 10 * runtime.NumCPU()
 	}
+	readTimeout := time.Millisecond * time.Duration(cfg.Redis.ReadTimeout)
+	writeTimeout := time.Millisecond * time.Duration(cfg.Redis.WriteTimeout)
+	dialTimeout := time.Millisecond * time.Duration(cfg.Redis.DialTimeout)
 
-	ret.master = redis.NewClient(&redis.Options{
-		Addr:         cfg.Redis.Addr,
-		DB:           0,
-		ReadTimeout:  time.Millisecond * time.Duration(cfg.Redis.ReadTimeout),
-		WriteTimeout: time.Millisecond * time.Duration(cfg.Redis.WriteTimeout),
-		DialTimeout:  time.Millisecond * time.Duration(cfg.Redis.DialTimeout),
-		PoolSize:     cfg.Redis.MaxPoolSize,
-		MinIdleConns: minIdleConns,
-	})
-	ret.master.AddHook(redisTimingHook{})
-	_, err = ret.ping().Result()
-	if err != nil {
-		return
-	}
-	ret.readClients = make([]*redis.Client, 0)
-	for _, x := range cfg.Redis.Replicas {
-		// We are going to add the master later; if we also see it specified in the replica
-		// configuration just skip it for now
-		if x == cfg.Redis.Addr {
-			continue
+	switch cfg.Redis.Mode {
+	case RedisModeSentinel:
+		opts := &redis.FailoverOptions{
+			MasterName:       cfg.Redis.Sentinel.MasterName,
+			SentinelAddrs:    cfg.Redis.Sentinel.Addrs,
+			SentinelUsername: cfg.Redis.Sentinel.Username,
+			SentinelPassword: cfg.Redis.Sentinel.Password,
+			Username:         cfg.Redis.Username,
+			Password:         cfg.Redis.Password,
+			DB:               cfg.Redis.DB,
+			TLSConfig:        tlsConfig,
+			ReadTimeout:      readTimeout,
+			WriteTimeout:     writeTimeout,
+			DialTimeout:      dialTimeout,
+			PoolSize:         cfg.Redis.MaxPoolSize,
+			MinIdleConns:     minIdleConns,
 		}
-		y := redis.NewClient(&redis.Options{
-			Addr:         x,
-			DB:           0,
-			ReadTimeout:  time.Millisecond * time.Duration(cfg.Redis.ReadTimeout),
-			DialTimeout:  time.Millisecond * time.Duration(cfg.Redis.DialTimeout),
+		ret.master = redis.NewFailoverClient(opts)
+		ret.master.AddHook(redisTimingHook{})
+		ret.readClients = make([]redis.UniversalClient, 0)
+		if cfg.Redis.ReadFromReplicas {
+			ropts := *opts
+			ropts.SlaveOnly = true
+			y := redis.NewFailoverClient(&ropts)
+			y.AddHook(redisTimingHook{})
+			ret.readClients = append(ret.readClients, y)
+		}
+	case RedisModeCluster:
+		ret.cluster = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:         cfg.Redis.Cluster.Addrs,
+			Username:      cfg.Redis.Username,
+			Password:      cfg.Redis.Password,
+			TLSConfig:     tlsConfig,
+			ReadOnly:      cfg.Redis.ReadFromReplicas,
+			RouteRandomly: cfg.Redis.ReadFromReplicas,
+			ReadTimeout:   readTimeout,
+			WriteTimeout:  writeTimeout,
+			DialTimeout:   dialTimeout,
+			PoolSize:      cfg.Redis.MaxPoolSize,
+			MinIdleConns:  minIdleConns,
+		})
+		ret.master = ret.cluster
+		ret.master.AddHook(redisTimingHook{})
+		// The cluster client routes reads to replicas itself if configured to do
+		// so, so it is the only read client we need
+		ret.readClients = make([]redis.UniversalClient, 0)
+	default:
+		ret.master = redis.NewClient(&redis.Options{
+			Addr:         cfg.Redis.Addr,
+			Username:     cfg.Redis.Username,
+			Password:     cfg.Redis.Password,
+			DB:           cfg.Redis.DB,
+			TLSConfig:    tlsConfig,
+			ReadTimeout:  readTimeout,
+			WriteTimeout: writeTimeout,
+			DialTimeout:  dialTimeout,
 			PoolSize:     cfg.Redis.MaxPoolSize,
 			MinIdleConns: minIdleConns,
 		})
-		y.AddHook(redisTimingHook{})
-		ret.readClients = append(ret.readClients, y)
+		ret.master.AddHook(redisTimingHook{})
+		ret.readClients = make([]redis.UniversalClient, 0)
+		for _, x := range cfg.Redis.Replicas {
+			// We are going to add the master later; if we also see it specified in the replica
+			// configuration just skip it for now
+			if x == cfg.Redis.Addr {
+				continue
+			}
+			y := redis.NewClient(&redis.Options{
+				Addr:         x,
+				Username:     cfg.Redis.Username,
+				Password:     cfg.Redis.Password,
+				DB:           cfg.Redis.DB,
+				TLSConfig:    tlsConfig,
+				ReadTimeout:  readTimeout,
+				DialTimeout:  dialTimeout,
+				PoolSize:     cfg.Redis.MaxPoolSize,
+				MinIdleConns: minIdleConns,
+			})
+			y.AddHook(redisTimingHook{})
+			ret.readClients = append(ret.readClients, y)
+		}
+	}
+	err = ret.Ping()
+	if err != nil {
+		return nil, err
 	}
 	// Also use the master for reads
 	ret.readClients = append(ret.readClients, ret.master)
@@ -0,0 +1,662 @@
+package iprepd
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterKeySlot(t *testing.T) {
+	assert.Equal(t, uint16(0x31c3), crc16("123456789"))
+	assert.Equal(t, 12182, clusterKeySlot("foo"))
+	assert.Equal(t, clusterKeySlot("user1000"), clusterKeySlot("{user1000}.followers"))
+	// An empty hash tag results in the whole key being hashed
+	assert.Equal(t, int(crc16("{}foo")%16384), clusterKeySlot("{}foo"))
+}
+
+func writeTestCert(t *testing.T, dir string, name string, tmpl *x509.Certificate,
+	parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	kder, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, name+".pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600)
+	assert.Nil(t, err)
+	return cert, key
+}
+
+func TestRedisTLSConfig(t *testing.T) {
+	var cfg ServerCfg
+	tc, err := redisTLSConfig(cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, tc)
+
+	dir, err := ioutil.TempDir("", "iprepd")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ca, caKey := writeTestCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "iprepd test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	writeTestCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "iprepd"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	cfg.Redis.TLS.Enable = true
+	cfg.Redis.TLS.ServerName = "redis.example.com"
+	cfg.Redis.TLS.CACert = filepath.Join(dir, "ca.pem")
+	cfg.Redis.TLS.Cert = filepath.Join(dir, "client.pem")
+	cfg.Redis.TLS.Key = filepath.Join(dir, "client-key.pem")
+	tc, err = redisTLSConfig(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, "redis.example.com", tc.ServerName)
+	assert.Equal(t, 1, len(tc.Certificates))
+	assert.NotNil(t, tc.RootCAs)
+
+	// A CA bundle with no certificates should be rejected
+	cfg.Redis.TLS.CACert = filepath.Join(dir, "client-key.pem")
+	_, err = redisTLSConfig(cfg)
+	assert.NotNil(t, err)
+
+	// A missing client key should be rejected
+	cfg.Redis.TLS.CACert = filepath.Join(dir, "ca.pem")
+	cfg.Redis.TLS.Key = filepath.Join(dir, "missing.pem")
+	_, err = redisTLSConfig(cfg)
+	assert.NotNil(t, err)
+}
+
+// fakeRedis is a minimal in-process Redis server implementing the commands used by
+// redisLink, so the Redis store can be tested without a Redis server. WATCH is
+// implemented using a version for each key that is incremented on every write. If
+// slots is set the server acts as a Redis Cluster node serving those hash slots,
+// and if master is set it acts as a Sentinel monitoring that master.
+type fakeRedis struct {
+	sync.Mutex
+	ln      net.Listener
+	data    map[string]fakeRedisEntry
+	version map[string]uint64
+
+	// aborted counts transactions that were aborted because a watched key was
+	// modified
+	aborted int
+
+	slots   [2]int
+	cluster *[]*fakeRedis
+	master  string
+}
+
+type fakeRedisEntry struct {
+	value   string
+	expires time.Time
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	f := &fakeRedis{
+		ln:      ln,
+		data:    make(map[string]fakeRedisEntry),
+		version: make(map[string]uint64),
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+// newFakeRedisCluster returns n fakeRedis instances acting as the nodes of a Redis
+// Cluster, with the hash slots split evenly between them
+func newFakeRedisCluster(t *testing.T, n int) []*fakeRedis {
+	nodes := make([]*fakeRedis, n)
+	for i := range nodes {
+		nodes[i] = newFakeRedis(t)
+		nodes[i].slots = [2]int{16384 * i / n, 16384*(i+1)/n - 1}
+		nodes[i].cluster = &nodes
+	}
+	return nodes
+}
+
+func (f *fakeRedis) addr() string {
+	return f.ln.Addr().String()
+}
+
+// set writes a value directly, as if it was written by another client
+func (f *fakeRedis) set(k string, v string) {
+	f.Lock()
+	f.data[k] = fakeRedisEntry{value: v}
+	f.version[k]++
+	f.Unlock()
+}
+
+func (f *fakeRedis) get(k string) (string, bool) {
+	f.Lock()
+	defer f.Unlock()
+	e, ok := f.data[k]
+	if !ok || (!e.expires.IsZero() && time.Now().After(e.expires)) {
+		return "", false
+	}
+	return e.value, true
+}
+
+// fakeRedisConn holds the state of a client connection
+type fakeRedisConn struct {
+	watched map[string]uint64
+	queue   [][]string
+	multi   bool
+	pubsub  bool
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	var (
+		r  = bufio.NewReader(c)
+		w  = bufio.NewWriter(c)
+		cs fakeRedisConn
+	)
+	for {
+		cmd, err := readFakeRedisCommand(r)
+		if err != nil {
+			return
+		}
+		f.Lock()
+		reply := f.handle(&cs, cmd)
+		f.Unlock()
+		w.WriteString(reply)
+		w.Flush()
+	}
+}
+
+func readFakeRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[0] != '*' {
+		return nil, fmt.Errorf("unexpected command %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, n)
+	for i := range ret {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		l, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, l+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = string(buf[:l])
+	}
+	return ret, nil
+}
+
+func respBulk(s string) string {
+	return fmt.Sprintf("$%v\r\n%v\r\n", len(s), s)
+}
+
+func respArray(items ...string) string {
+	return fmt.Sprintf("*%v\r\n%v", len(items), strings.Join(items, ""))
+}
+
+func respInt(n int) string {
+	return fmt.Sprintf(":%v\r\n", n)
+}
+
+const (
+	respOK     = "+OK\r\n"
+	respNil    = "$-1\r\n"
+	respNilArr = "*-1\r\n"
+)
+
+// keys returns the keys command cmd operates on
+func fakeRedisKeys(cmd []string) []string {
+	switch strings.ToLower(cmd[0]) {
+	case "get", "set", "ttl":
+		return cmd[1:2]
+	case "mget", "del", "watch":
+		return cmd[1:]
+	}
+	return nil
+}
+
+// checkSlots returns an error reply if keys do not all belong to the same hash
+// slot, or the slot is not served by this node. It returns an empty string if
+// the server is not a cluster node.
+func (f *fakeRedis) checkSlots(keys []string) string {
+	if f.cluster == nil || len(keys) == 0 {
+		return ""
+	}
+	s := clusterKeySlot(keys[0])
+	for _, k := range keys[1:] {
+		if clusterKeySlot(k) != s {
+			return "-CROSSSLOT Keys in request don't hash to the same slot\r\n"
+		}
+	}
+	if s < f.slots[0] || s > f.slots[1] {
+		for _, n := range *f.cluster {
+			if s >= n.slots[0] && s <= n.slots[1] {
+				return fmt.Sprintf("-MOVED %v %v\r\n", s, n.addr())
+			}
+		}
+	}
+	return ""
+}
+
+func (f *fakeRedis) handle(cs *fakeRedisConn, cmd []string) string {
+	name := strings.ToLower(cmd[0])
+	if cs.multi && name != "exec" && name != "discard" {
+		if e := f.checkSlots(fakeRedisKeys(cmd)); e != "" {
+			return e
+		}
+		cs.queue = append(cs.queue, cmd)
+		return "+QUEUED\r\n"
+	}
+	switch name {
+	case "multi":
+		cs.multi = true
+		cs.queue = nil
+		return respOK
+	case "discard":
+		cs.multi = false
+		cs.watched = nil
+		return respOK
+	case "exec":
+		cs.multi = false
+		watched := cs.watched
+		cs.watched = nil
+		var keys []string
+		for _, c := range cs.queue {
+			keys = append(keys, fakeRedisKeys(c)...)
+		}
+		if e := f.checkSlots(keys); e != "" {
+			return e
+		}
+		for k, v := range watched {
+			if f.version[k] != v {
+				f.aborted++
+				return respNilArr
+			}
+		}
+		replies := make([]string, len(cs.queue))
+		for i, c := range cs.queue {
+			replies[i] = f.exec(cs, c)
+		}
+		return respArray(replies...)
+	case "watch":
+		if e := f.checkSlots(cmd[1:]); e != "" {
+			return e
+		}
+		if cs.watched == nil {
+			cs.watched = make(map[string]uint64)
+		}
+		for _, k := range cmd[1:] {
+			cs.watched[k] = f.version[k]
+		}
+		return respOK
+	case "unwatch":
+		cs.watched = nil
+		return respOK
+	}
+	if e := f.checkSlots(fakeRedisKeys(cmd)); e != "" {
+		return e
+	}
+	return f.exec(cs, cmd)
+}
+
+func (f *fakeRedis) exec(cs *fakeRedisConn, cmd []string) string {
+	now := time.Now()
+	lookup := func(k string) (string, bool) {
+		e, ok := f.data[k]
+		if !ok || (!e.expires.IsZero() && now.After(e.expires)) {
+			return "", false
+		}
+		return e.value, true
+	}
+	switch strings.ToLower(cmd[0]) {
+	case "ping":
+		if cs.pubsub {
+			return respArray(respBulk("pong"), respBulk(""))
+		}
+		return "+PONG\r\n"
+	case "get":
+		if v, ok := lookup(cmd[1]); ok {
+			return respBulk(v)
+		}
+		return respNil
+	case "mget":
+		items := make([]string, len(cmd)-1)
+		for i, k := range cmd[1:] {
+			items[i] = respNil
+			if v, ok := lookup(k); ok {
+				items[i] = respBulk(v)
+			}
+		}
+		return respArray(items...)
+	case "set":
+		e := fakeRedisEntry{value: cmd[2]}
+		if len(cmd) == 5 {
+			n, _ := strconv.Atoi(cmd[4])
+			switch strings.ToLower(cmd[3]) {
+			case "ex":
+				e.expires = now.Add(time.Duration(n) * time.Second)
+			case "px":
+				e.expires = now.Add(time.Duration(n) * time.Millisecond)
+			}
+		}
+		f.data[cmd[1]] = e
+		f.version[cmd[1]]++
+		return respOK
+	case "del":
+		n := 0
+		for _, k := range cmd[1:] {
+			if _, ok := lookup(k); ok {
+				n++
+			}
+			delete(f.data, k)
+			f.version[k]++
+		}
+		return respInt(n)
+	case "ttl":
+		e, ok := f.data[cmd[1]]
+		switch {
+		case !ok:
+			return respInt(-2)
+		case e.expires.IsZero():
+			return respInt(-1)
+		}
+		return respInt(int(time.Until(e.expires).Seconds()))
+	case "scan":
+		cursor, _ := strconv.Atoi(cmd[1])
+		match, count := "*", 10
+		for i := 2; i+1 < len(cmd); i += 2 {
+			switch strings.ToLower(cmd[i]) {
+			case "match":
+				match = cmd[i+1]
+			case "count":
+				count, _ = strconv.Atoi(cmd[i+1])
+			}
+		}
+		var keys []string
+		for k := range f.data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		end := cursor + count
+		if end >= len(keys) {
+			end = len(keys)
+		}
+		var items []string
+		for _, k := range keys[cursor:end] {
+			if _, ok := lookup(k); ok && globMatch(match, k) {
+				items = append(items, respBulk(k))
+			}
+		}
+		next := end
+		if next == len(keys) {
+			next = 0
+		}
+		return respArray(respBulk(strconv.Itoa(next)), respArray(items...))
+	case "flushall":
+		for k := range f.data {
+			f.version[k]++
+		}
+		f.data = make(map[string]fakeRedisEntry)
+		return respOK
+	case "cluster":
+		if f.cluster == nil || strings.ToLower(cmd[1]) != "slots" {
+			break
+		}
+		var items []string
+		for i, n := range *f.cluster {
+			host, port, _ := net.SplitHostPort(n.addr())
+			p, _ := strconv.Atoi(port)
+			items = append(items, respArray(respInt(n.slots[0]), respInt(n.slots[1]),
+				respArray(respBulk(host), respInt(p), respBulk(fmt.Sprintf("node%v", i)))))
+		}
+		return respArray(items...)
+	case "sentinel":
+		if f.master == "" {
+			break
+		}
+		switch strings.ToLower(cmd[1]) {
+		case "get-master-addr-by-name":
+			host, port, _ := net.SplitHostPort(f.master)
+			return respArray(respBulk(host), respBulk(port))
+		case "sentinels":
+			return respArray()
+		}
+	case "subscribe":
+		cs.pubsub = true
+		var ret string
+		for i, ch := range cmd[1:] {
+			ret += respArray(respBulk("subscribe"), respBulk(ch), respInt(i+1))
+		}
+		return ret
+	}
+	return fmt.Sprintf("-ERR unknown command '%v'\r\n", cmd[0])
+}
+
+// newFakeRedisLink returns a redisLink connected to the fake servers using mode
+func newFakeRedisLink(t *testing.T, mode string, addrs ...string) *redisLink {
+	var cfg ServerCfg
+	cfg.Redis.Mode = mode
+	switch mode {
+	case RedisModeStandalone:
+		cfg.Redis.Addr = addrs[0]
+	case RedisModeSentinel:
+		cfg.Redis.Sentinel.MasterName = "iprepd"
+		cfg.Redis.Sentinel.Addrs = addrs
+	case RedisModeCluster:
+		cfg.Redis.Cluster.Addrs = addrs
+	}
+	assert.Nil(t, cfg.validate())
+	r, err := newRedisLink(cfg)
+	assert.Nil(t, err)
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// testRedisUpdate verifies updates of enough keys to be split into several
+// transactions are applied through r, against the fake servers in nodes
+func testRedisUpdate(t *testing.T, r *redisLink, nodes []*fakeRedis) {
+	lookup := func(k string) (string, bool) {
+		for _, n := range nodes {
+			if v, ok := n.get(k); ok {
+				return v, true
+			}
+		}
+		return "", false
+	}
+	n := redisUpdateBatchSize*2 + 10
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("ip 10.2.%v.%v", i/256, i%256)
+	}
+	err := r.Update(keys, func(i int, cur []byte) (StoreValue, error) {
+		return StoreValue{Value: append(cur, 'a'), Expiry: time.Hour}, nil
+	})
+	assert.Nil(t, err)
+	for _, k := range keys {
+		v, ok := lookup(k)
+		assert.True(t, ok, k)
+		assert.Equal(t, "a", v, k)
+	}
+	vals, err := r.MGet(keys[0], "ip 10.3.0.1", keys[n-1])
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), nil, []byte("a")}, vals)
+}
+
+func TestRedisUpdate(t *testing.T) {
+	f := newFakeRedis(t)
+	r := newFakeRedisLink(t, RedisModeStandalone, f.addr())
+	testRedisUpdate(t, r, []*fakeRedis{f})
+
+	// Modify a key while the update is in progress. Only the transaction
+	// containing that key should be retried.
+	keys := make([]string, redisUpdateBatchSize*2)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("ip 10.4.%v.%v", i/256, i%256)
+	}
+	calls := make([]int, len(keys))
+	err := r.Update(keys, func(i int, cur []byte) (StoreValue, error) {
+		calls[i]++
+		if i == 0 && calls[i] == 1 {
+			f.set(keys[0], "b")
+		}
+		return StoreValue{Value: append(cur, 'a')}, nil
+	})
+	assert.Nil(t, err)
+	v, _ := f.get(keys[0])
+	assert.Equal(t, "ba", v)
+	assert.Equal(t, 1, f.aborted)
+	for i := range keys {
+		if i < redisUpdateBatchSize {
+			assert.Equal(t, 2, calls[i])
+		} else {
+			assert.Equal(t, 1, calls[i])
+		}
+	}
+
+	// An error from fn should abort the update
+	err = r.Update(keys[:1], func(i int, cur []byte) (StoreValue, error) {
+		return StoreValue{}, ErrNotFound
+	})
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestRedisConcurrentViolations(t *testing.T) {
+	f := newFakeRedis(t)
+	r := newFakeRedisLink(t, RedisModeStandalone, f.addr())
+	prev := sruntime.store
+	sruntime.store = r
+	defer func() { sruntime.store = prev }()
+
+	// Apply batches of violations for the same objects concurrently; none of the
+	// penalties should be lost
+	objs := []string{"192.168.7.1", "192.168.7.2", "192.168.7.3"}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var vs []ViolationRequest
+			for _, o := range objs {
+				vs = append(vs, ViolationRequest{Object: o, Type: TypeIP, Violation: "violation1"})
+			}
+			_, err := repApplyViolations(vs)
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+	for _, o := range objs {
+		rep, err := repGet(TypeIP, o)
+		assert.Nil(t, err)
+		assert.Equal(t, 75, rep.Reputation)
+	}
+}
+
+func TestRedisCluster(t *testing.T) {
+	nodes := newFakeRedisCluster(t, 2)
+	r := newFakeRedisLink(t, RedisModeCluster, nodes[0].addr())
+	testRedisUpdate(t, r, nodes)
+
+	// Each node should only hold keys in its own hash slots, and both nodes
+	// should have been written to
+	for _, n := range nodes {
+		n.Lock()
+		assert.NotZero(t, len(n.data))
+		for k := range n.data {
+			s := int(clusterKeySlot(k))
+			assert.True(t, s >= n.slots[0] && s <= n.slots[1], k)
+		}
+		n.Unlock()
+	}
+
+	// A scan should return the keys from every node
+	var (
+		keys   []string
+		cursor uint64
+		prev   uint64
+	)
+	for {
+		k, next, err := r.Scan(cursor, "ip *", 50)
+		assert.Nil(t, err)
+		keys = append(keys, k...)
+		if next == 0 {
+			break
+		}
+		prev, cursor = cursor, next
+	}
+	assert.Equal(t, redisUpdateBatchSize*2+10, len(keys))
+	assert.NotZero(t, prev)
+
+	// A cursor from a different cluster topology should be rejected rather than
+	// silently skipping keys
+	_, _, err := r.Scan(prev^1<<clusterTopologyShift, "ip *", 50)
+	assert.EqualError(t, err, "cluster topology changed during scan")
+}
+
+func TestRedisSentinel(t *testing.T) {
+	f := newFakeRedis(t)
+	s := newFakeRedis(t)
+	s.master = f.addr()
+	r := newFakeRedisLink(t, RedisModeSentinel, s.addr())
+	testRedisUpdate(t, r, []*fakeRedis{f})
+	s.Lock()
+	assert.Zero(t, len(s.data))
+	s.Unlock()
+}
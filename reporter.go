@@ -0,0 +1,120 @@
+package iprepd
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// validateReporters validates the reporter weight and corroboration configuration
+func (cfg *ServerCfg) validateReporters() error {
+	for k, v := range cfg.Reporters.Weights {
+		if v < 0 {
+			return fmt.Errorf("invalid weight for reporter %v", k)
+		}
+	}
+	c := &cfg.Reporters.Corroboration
+	if c.Sources < 0 {
+		return fmt.Errorf("invalid corroboration sources %v", c.Sources)
+	}
+	if c.Sources > 1 && c.Window <= 0 {
+		return fmt.Errorf("corroboration requires a window")
+	}
+	if c.Weight < 0 || c.Weight > 1 {
+		return fmt.Errorf("invalid corroboration weight %v", c.Weight)
+	}
+	// With a weight of 0 violations would have no effect at all until they are
+	// corroborated, which is easy to configure by accident by leaving it unset
+	if c.Sources > 1 && c.Weight == 0 {
+		return fmt.Errorf("corroboration requires a weight")
+	}
+	return nil
+}
+
+// violationReporter returns the reporter a violation request submitted by
+// principal is attributed to, and the source recorded for it. Weights and
+// corroboration are based on the reporter, which is the authenticated principal,
+// so a client can't claim the weight of another reporter or corroborate its own
+// violations by varying the source in its requests. The source included in the
+// request is only a label, and is namespaced under the principal. If there is no
+// principal, for example if authentication is disabled, the source in the request
+// is used as the reporter.
+func violationReporter(principal string, source string) (reporter string, label string) {
+	switch {
+	case principal == "":
+		return source, source
+	case source == "" || source == principal:
+		return principal, principal
+	}
+	return principal, principal + "/" + source
+}
+
+// reporterWeight returns the weight penalties for violations submitted by reporter
+// with source label, as returned by violationReporter, are scaled by. A weight
+// configured for the label, for example "fxa/login", takes precedence over the
+// weight configured for the reporter, so individual detectors of a reporter can be
+// weighted differently. Reporters without a configured weight have a weight of 1.
+func (cfg *ServerCfg) reporterWeight(reporter string, label string) float64 {
+	if w, ok := cfg.Reporters.Weights[label]; ok {
+		return w
+	}
+	if w, ok := cfg.Reporters.Weights[reporter]; ok {
+		return w
+	}
+	return 1
+}
+
+// recordSource records that reporter reported a violation for the reputation, and
+// removes reporters that are outside the corroboration window. Only the most
+// recent reporters up to the number required for corroboration are kept. It
+// returns the number of distinct reporters that have reported violations within
+// the window.
+func (r *Reputation) recordSource(reporter string) int {
+	c := &sruntime.cfg.Reporters.Corroboration
+	if c.Sources <= 1 {
+		return 0
+	}
+	now := time.Now().UTC()
+	var keep []string
+	for k, t := range r.Sources {
+		if k != reporter && now.Sub(t) < c.Window {
+			keep = append(keep, k)
+		}
+	}
+	max := c.Sources
+	if reporter != "" {
+		max--
+	}
+	if len(keep) > max {
+		sort.Slice(keep, func(i, j int) bool {
+			return r.Sources[keep[i]].After(r.Sources[keep[j]])
+		})
+		keep = keep[:max]
+	}
+	s := make(map[string]time.Time, len(keep)+1)
+	for _, k := range keep {
+		s[k] = r.Sources[k]
+	}
+	if reporter != "" {
+		s[reporter] = now
+	}
+	r.Sources = s
+	return len(s)
+}
+
+// violationWeight returns the weight the penalty for a violation submitted by
+// reporter with source label should be scaled by. This is the weight configured
+// for the label or reporter, which is reduced further if corroboration is
+// configured and fewer than the required number of distinct reporters have
+// reported violations for the object within the window. Corroboration is always
+// based on the reporter, so the sources of a single reporter don't corroborate
+// each other.
+func (r *Reputation) violationWeight(reporter string, label string) float64 {
+	cfg := &sruntime.cfg
+	w := cfg.reporterWeight(reporter, label)
+	if n := r.recordSource(reporter); cfg.Reporters.Corroboration.Sources > 1 &&
+		n < cfg.Reporters.Corroboration.Sources {
+		w *= cfg.Reporters.Corroboration.Weight
+	}
+	return w
+}
@@ -0,0 +1,131 @@
+package iprepd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateReporters(t *testing.T) {
+	tests := []struct {
+		Weights map[string]float64
+		Sources int
+		Window  time.Duration
+		Weight  float64
+		Valid   bool
+	}{
+		{nil, 0, 0, 0, true},
+		{map[string]float64{"fxa": 0.5, "amo": 2}, 0, 0, 0, true},
+		{map[string]float64{"fxa": -1}, 0, 0, 0, false},
+		{nil, 2, time.Hour, 0.5, true},
+		{nil, 2, time.Hour, 0, false},
+		{nil, 2, 0, 0.5, false},
+		{nil, 2, time.Hour, 1.5, false},
+		{nil, -1, time.Hour, 0, false},
+	}
+	for i, tst := range tests {
+		var cfg ServerCfg
+		cfg.Reporters.Weights = tst.Weights
+		cfg.Reporters.Corroboration.Sources = tst.Sources
+		cfg.Reporters.Corroboration.Window = tst.Window
+		cfg.Reporters.Corroboration.Weight = tst.Weight
+		assert.Equal(t, tst.Valid, cfg.validateReporters() == nil, i)
+	}
+}
+
+func TestReporterWeights(t *testing.T) {
+	assert.Nil(t, baseTest())
+	sruntime.cfg.Reporters.Weights = map[string]float64{"noisy": 0.5, "trusted": 2, "u1": 0}
+	defer func() {
+		sruntime.cfg.Reporters.Weights = nil
+	}()
+
+	apply := func(principal string, vs ...ViolationRequest) []ViolationResult {
+		results, err := applyViolationRequests(TypeIP, principal, vs)
+		assert.Nil(t, err)
+		return results
+	}
+	results := apply("noisy", ViolationRequest{Object: "192.168.1.1", Violation: "violation1"})
+	assert.Equal(t, 97, results[0].Reputation.Reputation)
+	results = apply("trusted", ViolationRequest{Object: "192.168.1.2", Violation: "violation1", Source: "x"})
+	assert.Equal(t, 90, results[0].Reputation.Reputation)
+
+	// The weight is based on the principal, so claiming the source name of
+	// another reporter has no effect
+	results = apply("u2", ViolationRequest{Object: "192.168.1.3", Violation: "violation1", Source: "trusted"})
+	assert.Equal(t, 95, results[0].Reputation.Reputation)
+	hist, err := historyGet(TypeIP, "192.168.1.3")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(hist))
+	assert.Equal(t, "u2/trusted", hist[0].Source)
+
+	results = apply("u1", ViolationRequest{Object: "192.168.1.1", Violation: "violation1"})
+	assert.Equal(t, 97, results[0].Reputation.Reputation)
+	hist, err = historyGet(TypeIP, "192.168.1.1")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(hist))
+	assert.Equal(t, "noisy", hist[0].Source)
+	assert.Equal(t, 3, hist[0].Penalty)
+	assert.Equal(t, "u1", hist[1].Source)
+	assert.Equal(t, 0, hist[1].Penalty)
+
+	// A weight configured for a source of the principal takes precedence over
+	// the weight of the principal, but only for that principal
+	sruntime.cfg.Reporters.Weights = map[string]float64{"pipe/det1": 0.5, "pipe": 2}
+	results = apply("pipe", ViolationRequest{Object: "192.168.1.4", Violation: "violation1", Source: "det1"})
+	assert.Equal(t, 97, results[0].Reputation.Reputation)
+	results = apply("pipe", ViolationRequest{Object: "192.168.1.5", Violation: "violation1", Source: "det2"})
+	assert.Equal(t, 90, results[0].Reputation.Reputation)
+	results = apply("pipe", ViolationRequest{Object: "192.168.1.6", Violation: "violation1"})
+	assert.Equal(t, 90, results[0].Reputation.Reputation)
+	results = apply("u2", ViolationRequest{Object: "192.168.1.7", Violation: "violation1", Source: "pipe/det1"})
+	assert.Equal(t, 95, results[0].Reputation.Reputation)
+}
+
+func TestCorroboration(t *testing.T) {
+	assert.Nil(t, baseTest())
+	sruntime.cfg.Reporters.Corroboration.Sources = 2
+	sruntime.cfg.Reporters.Corroboration.Window = time.Hour
+	sruntime.cfg.Reporters.Corroboration.Weight = 0.2
+	defer func() {
+		sruntime.cfg.Reporters.Corroboration.Sources = 0
+		sruntime.cfg.Reporters.Corroboration.Window = 0
+		sruntime.cfg.Reporters.Corroboration.Weight = 0
+	}()
+
+	apply := func(principal string, vs ...ViolationRequest) []ViolationResult {
+		results, err := applyViolationRequests(TypeIP, principal, vs)
+		assert.Nil(t, err)
+		return results
+	}
+
+	// Violations are reduced until a second principal reports the object, and a
+	// single principal can't corroborate its own violations by varying the source
+	results := apply("a",
+		ViolationRequest{Object: "192.168.1.1", Violation: "violation1", Source: "x"},
+		ViolationRequest{Object: "192.168.1.1", Violation: "violation1", Source: "y"},
+		ViolationRequest{Object: "192.168.1.1", Violation: "violation1", Source: "z"},
+	)
+	assert.Equal(t, 99, results[0].Reputation.Reputation)
+	assert.Equal(t, 98, results[1].Reputation.Reputation)
+	assert.Equal(t, 97, results[2].Reputation.Reputation)
+	assert.Equal(t, 1, len(results[2].Reputation.Sources))
+	results = apply("b", ViolationRequest{Object: "192.168.1.1", Violation: "violation1"})
+	assert.Equal(t, 92, results[0].Reputation.Reputation)
+	assert.Equal(t, 2, len(results[0].Reputation.Sources))
+
+	// Only as many reporters as are needed for corroboration are kept
+	results = apply("c", ViolationRequest{Object: "192.168.1.1", Violation: "violation1"})
+	assert.Equal(t, 87, results[0].Reputation.Reputation)
+	assert.Equal(t, 2, len(results[0].Reputation.Sources))
+	_, ok := results[0].Reputation.Sources["a"]
+	assert.False(t, ok)
+
+	// Reporters outside the window no longer count towards corroboration
+	sruntime.cfg.Reporters.Corroboration.Window = time.Millisecond
+	time.Sleep(time.Millisecond * 5)
+	results = apply("a", ViolationRequest{Object: "192.168.1.1", Violation: "violation1"})
+	assert.Equal(t, 86, results[0].Reputation.Reputation)
+	assert.Equal(t, 1, len(results[0].Reputation.Sources))
+}
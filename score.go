@@ -3,7 +3,9 @@ package iprepd
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -35,6 +37,73 @@ type Reputation struct {
 	// to for example enforce a mandatory minimum reputation decrease for an object
 	// for a set period of time.
 	DecayAfter time.Time `json:"decayafter,omitempty"`
+
+	// Offenses, Events, Sources and Deductions are bookkeeping used when applying
+	// violations. They are stored with the entry (see storedReputation), but are
+	// not included in API responses and can't be set in a PUT.
+
+	// Offenses records when violations that have escalation configured were
+	// applied to the object, keyed by violation name. Only offenses within the
+	// escalation window of the violation are kept, up to the number that can still
+	// change the penalty (see Violation.maxOffenses).
+	Offenses map[string][]time.Time `json:"-"`
+
+	// Events records the event IDs of violation requests recently applied to the
+	// object, along with when they were applied. Requests with an event ID that
+	// has already been applied within the configured window are skipped. At most
+	// the configured maximum number of the most recent event IDs are kept.
+	Events map[string]time.Time `json:"-"`
+
+	// Sources records the sources that recently reported violations for the
+	// object, along with when they last did so. It is only kept if corroboration
+	// is configured.
+	Sources map[string]time.Time `json:"-"`
+
+	// Deductions records the reputation points lost to violations within the
+	// penalty budget window. It is only kept if a penalty budget is configured.
+	Deductions []Deduction `json:"-"`
+
+	// Decay is the name of the decay strategy selected by the last violation
+	// applied to the entry that specified one. It is cleared once the reputation
+	// recovers to 100.
+	Decay string `json:"decay,omitempty"`
+
+	// Network is set if the object has no reputation entry of its own, and the
+	// reputation was derived from the aggregate reputation of the network
+	// enclosing the object. It contains the network in CIDR notation.
+	Network string `json:"network,omitempty"`
+
+	// Domain is set if the object is an email address that has no reputation
+	// entry of its own, and the reputation returned is the aggregate reputation
+	// for the domain of the address
+	Domain string `json:"domain,omitempty"`
+
+	// Band and Action are set in lookups and dumps if score bands are configured,
+	// and indicate the band the reputation falls in and the recommended action for
+	// the object. They are derived from the current score when a response is
+	// built, and are never stored.
+	Band   string `json:"band,omitempty"`
+	Action string `json:"action,omitempty"`
+
+	// Pinned is true if the reputation has been pinned to its current score.
+	// While pinned, violations and decay do not change the score, however
+	// violations applied to the object are still recorded.
+	Pinned bool `json:"pinned,omitempty"`
+
+	// PinExpires optionally indicates when the pin expires, after which the
+	// reputation is no longer pinned.
+	PinExpires time.Time `json:"pinexpires,omitempty"`
+
+	// PinReason is an optional reason the reputation was pinned
+	PinReason string `json:"pinreason,omitempty"`
+
+	// Tags is an optional list of free-form tags associated with the entry, for
+	// example the product that reported the object or a campaign name
+	Tags []string `json:"tags,omitempty"`
+
+	// Metadata is optional free-form information associated with the entry, for
+	// example a ticket ID
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 // Validate performs validation  of a Reputation type.
@@ -48,9 +117,111 @@ func (r *Reputation) Validate() error {
 	if r.Reputation < 0 || r.Reputation > 100 {
 		return fmt.Errorf("invalid reputation score %v", r.Reputation)
 	}
+	return validateTags(r.Tags, r.Metadata)
+}
+
+// IsPinned returns true if the reputation is currently pinned
+func (r *Reputation) IsPinned() bool {
+	return r.Pinned && (r.PinExpires.IsZero() || r.PinExpires.After(time.Now().UTC()))
+}
+
+// pin pins the reputation to score rep until expires, or indefinitely if expires
+// is the zero value
+func (r *Reputation) pin(rep int, expires time.Time, reason string) {
+	r.Reputation = rep
+	r.Pinned = true
+	r.PinExpires = expires
+	r.PinReason = reason
+}
+
+// unpin removes any pin from the reputation
+func (r *Reputation) unpin() {
+	r.Pinned = false
+	r.PinExpires = time.Time{}
+	r.PinReason = ""
+}
+
+// validateTags validates tags and metadata against the configured limits. A limit
+// of 0 is not enforced, which is the case in programs using the Client.
+func validateTags(tags []string, metadata map[string]string) error {
+	l := &sruntime.cfg.Tags
+	if l.MaxTags > 0 && len(tags) > l.MaxTags {
+		return fmt.Errorf("number of tags exceeds maximum of %v", l.MaxTags)
+	}
+	for _, t := range tags {
+		if t == "" {
+			return fmt.Errorf("tags must not be empty")
+		}
+		if l.MaxTagLength > 0 && len(t) > l.MaxTagLength {
+			return fmt.Errorf("tag exceeds maximum length of %v", l.MaxTagLength)
+		}
+	}
+	if l.MaxMetadata > 0 && len(metadata) > l.MaxMetadata {
+		return fmt.Errorf("number of metadata keys exceeds maximum of %v", l.MaxMetadata)
+	}
+	for k, v := range metadata {
+		if l.MaxMetadataLength > 0 && (len(k) > l.MaxMetadataLength || len(v) > l.MaxMetadataLength) {
+			return fmt.Errorf("metadata exceeds maximum length of %v", l.MaxMetadataLength)
+		}
+	}
 	return nil
 }
 
+func hasTag(tags []string, t string) bool {
+	for _, x := range tags {
+		if x == t {
+			return true
+		}
+	}
+	return false
+}
+
+// HasTags returns true if the reputation has all of the specified tags
+func (r *Reputation) HasTags(tags ...string) bool {
+	for _, t := range tags {
+		if !hasTag(r.Tags, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeTags adds tags and metadata to the reputation. Tags the reputation already
+// has are not duplicated, and metadata replaces any existing value for the same
+// key. Once the reputation has the configured maximum number of tags or metadata
+// keys, further new tags and keys are not added, so the entry can't grow without
+// bound.
+func (r *Reputation) mergeTags(tags []string, metadata map[string]string) {
+	l := &sruntime.cfg.Tags
+	if len(tags) > 0 {
+		nt := append([]string{}, r.Tags...)
+		for _, t := range tags {
+			if !hasTag(nt, t) && (l.MaxTags == 0 || len(nt) < l.MaxTags) {
+				nt = append(nt, t)
+			}
+		}
+		r.Tags = nt
+	}
+	if len(metadata) > 0 {
+		nm := make(map[string]string, len(r.Metadata)+len(metadata))
+		for k, v := range r.Metadata {
+			nm[k] = v
+		}
+		// Add keys in order, so which keys are dropped at the limit is consistent
+		keys := make([]string, 0, len(metadata))
+		for k := range metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if _, ok := nm[k]; ok || l.MaxMetadata == 0 || len(nm) < l.MaxMetadata {
+				nm[k] = metadata[k]
+			}
+		}
+		r.Metadata = nm
+	}
+}
+
 func normalizedObjectValue(typestr string, valstr string) (string, error) {
 	if typestr == TypeIP {
 		ip := net.ParseIP(valstr)
@@ -71,6 +242,12 @@ func normalizedObjectValue(typestr string, valstr string) (string, error) {
 			}
 		}
 	}
+	if typestr == TypeEmail {
+		return sruntime.cfg.Email.normalize(valstr), nil
+	}
+	if ot, ok := getType(typestr); ok && ot.normalize != nil {
+		return ot.normalize(valstr), nil
+	}
 	return valstr, nil
 }
 
@@ -101,45 +278,256 @@ func keyFromTypeAndValue(typestr string, valstr string) (string, error) {
 	return typestr + " " + buf, nil
 }
 
-func (r *Reputation) set() error {
-	err := r.Validate()
+// expiry returns how long the reputation entry should be retained in the store.
+// This is the retention period configured for the object type, however entries
+// that have not been reviewed expire shortly after they will have decayed back to
+// 100. No entry expires before the time indicated by DecayAfter or PinExpires, or
+// while it has offenses within an escalation window, recent event IDs or recent
+// sources. Entries that are pinned without an expiry are retained indefinitely,
+// and 0 is returned.
+//
+// expiry should be called after encode, since it is based on LastUpdated.
+func (r *Reputation) expiry() time.Duration {
+	var (
+		cfg = &sruntime.cfg
+		now = time.Now().UTC()
+		ret = cfg.retention(r.Type)
+	)
+	if r.Pinned && r.PinExpires.IsZero() {
+		return 0
+	}
+	if !r.Reviewed {
+		recovered, ok := r.recoveredAt()
+		if ok {
+			d := recovered.Sub(now) + cfg.Retention.Recovered
+			if d < ret {
+				ret = d
+			}
+		}
+	}
+	if d := r.DecayAfter.Sub(now); d > ret {
+		ret = d
+	}
+	if d := r.PinExpires.Sub(now); r.Pinned && d > ret {
+		ret = d
+	}
+	for v, o := range r.Offenses {
+		viol := cfg.getViolation(r.Type, v)
+		if viol == nil || viol.Escalation == nil || len(o) == 0 {
+			continue
+		}
+		if d := o[len(o)-1].Add(viol.Escalation.Window).Sub(now); d > ret {
+			ret = d
+		}
+	}
+	for _, t := range r.Events {
+		if d := t.Add(cfg.Idempotency.Window).Sub(now); d > ret {
+			ret = d
+		}
+	}
+	for _, t := range r.Sources {
+		if d := t.Add(cfg.Reporters.Corroboration.Window).Sub(now); d > ret {
+			ret = d
+		}
+	}
+	return ret
+}
+
+// recoveredAt returns the time at which decay will have returned the reputation to
+// 100. If the decay strategy never returns the reputation to 100, or the
+// reputation is pinned indefinitely, ok is false.
+func (r *Reputation) recoveredAt() (t time.Time, ok bool) {
+	if r.Pinned && r.PinExpires.IsZero() {
+		return time.Time{}, false
+	}
+	d, ok := sruntime.cfg.decayFor(r).strategy().recoveryTime(r.Reputation)
+	if !ok {
+		return time.Time{}, false
+	}
+	t = r.LastUpdated.Add(d)
+	// Decay is calculated from the last update once DecayAfter or the pin has
+	// expired, so the entry recovers immediately at that point if it would
+	// otherwise have recovered before then
+	if r.DecayAfter.After(t) {
+		t = r.DecayAfter
+	}
+	if r.Pinned && r.PinExpires.After(t) {
+		t = r.PinExpires
+	}
+	return t, true
+}
+
+// storedReputation is the form of a reputation entry that is written to the store,
+// which adds the bookkeeping fields that are excluded from the JSON encoding of
+// Reputation used in API responses
+type storedReputation struct {
+	Reputation
+	Offenses   map[string][]time.Time `json:"offenses,omitempty"`
+	Events     map[string]time.Time   `json:"events,omitempty"`
+	Sources    map[string]time.Time   `json:"sources,omitempty"`
+	Deductions []Deduction            `json:"deductions,omitempty"`
+}
+
+// encode validates and normalizes the reputation, updates the last updated time,
+// and returns the key and value that should be stored for the entry
+func (r *Reputation) encode() (key string, buf []byte, err error) {
+	err = r.Validate()
 	if err != nil {
-		return err
+		return
 	}
 	r.Object, err = normalizedObjectValue(r.Type, r.Object)
 	if err != nil {
-		return err
+		return
 	}
 	r.LastUpdated = time.Now().UTC()
-	buf, err := json.Marshal(r)
+	s := storedReputation{
+		Reputation: *r,
+		Offenses:   r.Offenses,
+		Events:     r.Events,
+		Sources:    r.Sources,
+		Deductions: r.Deductions,
+	}
+	s.Band, s.Action = "", ""
+	buf, err = json.Marshal(s)
 	if err != nil {
-		return err
+		return
 	}
-	key, err := keyFromTypeAndValue(r.Type, r.Object)
+	key, err = keyFromTypeAndValue(r.Type, r.Object)
+	return
+}
+
+func (r *Reputation) set() error {
+	key, buf, err := r.encode()
 	if err != nil {
 		return err
 	}
-	return sruntime.redis.set(key, buf, time.Hour*336).Err()
+	return sruntime.store.Set(key, buf, r.expiry())
 }
 
-func (r *Reputation) applyViolation(v string) (found bool, err error) {
-	viol := sruntime.cfg.getViolation(v)
+// applyViolation applies violation v to the reputation, returning the penalty that
+// was used. If escalation is configured for the violation, the penalty depends on
+// the number of times the violation has been applied to the object within the
+// escalation window. The penalty is scaled by weight, which reflects confidence in
+// the source of the violation. If the reputation is pinned the violation is tracked
+// for escalation, but the score is not changed.
+//
+// If a penalty budget is configured the decrease is limited to the remaining
+// budget for the object, and limited is true if any of the penalty was not
+// applied as a result.
+func (r *Reputation) applyViolation(v string, weight float64) (penalty int, limited bool, err error) {
+	viol := sruntime.cfg.getViolation(r.Type, v)
 	if viol == nil {
-		return false, fmt.Errorf("invalid violation: %v", v)
+		return 0, false, fmt.Errorf("invalid violation: %v", v)
+	}
+	penalty = viol.Penalty
+	if viol.Decay != "" {
+		r.Decay = viol.Decay
+	}
+	if viol.Escalation != nil {
+		now := time.Now().UTC()
+		r.pruneOffenses(now)
+		n := len(r.Offenses[v])
+		penalty = viol.penalty(n)
+		if n > 0 && viol.Escalation.SuppressRecovery > 0 {
+			nd := now.Add(viol.Escalation.SuppressRecovery * time.Duration(n))
+			if r.DecayAfter.Before(nd) {
+				r.DecayAfter = nd
+			}
+		}
+		o := append(r.Offenses[v], now)
+		if m := viol.maxOffenses(); len(o) > m {
+			o = o[len(o)-m:]
+		}
+		r.Offenses[v] = o
+	}
+	if weight != 1 {
+		penalty = int(math.Round(float64(penalty) * weight))
 	}
-	found = true
-	if r.Reputation <= viol.DecreaseLimit {
+	if r.IsPinned() || r.Reputation <= viol.DecreaseLimit {
 		return
 	}
-	if (r.Reputation - viol.Penalty) < viol.DecreaseLimit {
-		r.Reputation = viol.DecreaseLimit
-	} else {
-		r.Reputation -= viol.Penalty
+	n := penalty
+	if (r.Reputation - n) < viol.DecreaseLimit {
+		n = r.Reputation - viol.DecreaseLimit
 	}
+	d := r.deduct(n)
+	limited = d < n
+	r.Reputation -= d
 	return
 }
 
+// pruneOffenses replaces the offenses for the reputation with only those that are
+// still within the escalation window of the violation.
+func (r *Reputation) pruneOffenses(now time.Time) {
+	o := make(map[string][]time.Time)
+	for v, ts := range r.Offenses {
+		viol := sruntime.cfg.getViolation(r.Type, v)
+		if viol == nil || viol.Escalation == nil {
+			continue
+		}
+		var keep []time.Time
+		for _, t := range ts {
+			if now.Sub(t) < viol.Escalation.Window {
+				keep = append(keep, t)
+			}
+		}
+		if len(keep) > 0 {
+			o[v] = keep
+		}
+	}
+	r.Offenses = o
+}
+
+// seenEvent returns true if a violation request with event ID id has been applied
+// to the reputation within the configured window
+func (r *Reputation) seenEvent(id string) bool {
+	if id == "" {
+		return false
+	}
+	t, ok := r.Events[id]
+	return ok && time.Since(t) < sruntime.cfg.Idempotency.Window
+}
+
+// recordEvent records that a violation request with event ID id was applied to the
+// reputation, and removes event IDs that are outside the configured window. If
+// more than the configured maximum number of event IDs remain, the oldest are
+// removed.
+func (r *Reputation) recordEvent(id string) {
+	if id == "" {
+		return
+	}
+	now := time.Now().UTC()
+	ids := []string{id}
+	for k, t := range r.Events {
+		if k != id && now.Sub(t) < sruntime.cfg.Idempotency.Window {
+			ids = append(ids, k)
+		}
+	}
+	if len(ids) > sruntime.cfg.Idempotency.MaxEvents {
+		// Keep the new event ID first, followed by the most recent of the others
+		sort.SliceStable(ids[1:], func(i, j int) bool {
+			return r.Events[ids[i+1]].After(r.Events[ids[j+1]])
+		})
+		ids = ids[:sruntime.cfg.Idempotency.MaxEvents]
+	}
+	e := make(map[string]time.Time, len(ids))
+	for _, k := range ids {
+		e[k] = r.Events[k]
+	}
+	e[id] = now
+	r.Events = e
+}
+
 func (r *Reputation) applyDecay() error {
+	// Pinned reputations don't decay, and once the pin has expired it is removed
+	// and the reputation decays as normal
+	if r.Pinned {
+		if r.IsPinned() {
+			return nil
+		}
+		r.unpin()
+	}
+
 	// If DecayAfter is set and we haven't past the indicated timestamp yet
 	// don't do anything with the current reputation value.
 	//
@@ -152,14 +540,22 @@ func (r *Reputation) applyDecay() error {
 		r.DecayAfter = time.Time{}
 	}
 
-	x := sruntime.cfg.Decay.Points *
-		int(time.Since(r.LastUpdated)/sruntime.cfg.Decay.Interval)
+	x := sruntime.cfg.decayFor(r).strategy().recovered(r.Reputation,
+		time.Since(r.LastUpdated))
+	if x <= 0 {
+		return nil
+	}
 	if r.Reputation+x > 100 {
 		r.Reputation = 100
 		r.Reviewed = false
 	} else {
 		r.Reputation += x
 	}
+	// The selected decay strategy is no longer needed once the reputation has
+	// fully recovered
+	if r.Reputation >= 100 {
+		r.Decay = ""
+	}
 	return nil
 }
 
@@ -176,23 +572,106 @@ type Violation struct {
 	// reputation to. Since the same violation can be applied multiple times to
 	// the same object, this can be used to place a lower bound on the total decrease.
 	DecreaseLimit int `json:"decreaselimit"`
+
+	// Escalation optionally increases the penalty for objects that repeatedly
+	// have this violation applied to them.
+	Escalation *Escalation `json:"escalation,omitempty"`
+
+	// Decay optionally names the decay strategy used by reputations this
+	// violation is applied to.
+	Decay string `json:"decay,omitempty"`
 }
 
-func repGet(typestr string, valstr string) (ret Reputation, err error) {
-	var key string
-	key, err = keyFromTypeAndValue(typestr, valstr)
-	if err != nil {
-		return
+// Escalation configures increasing penalties for repeat offenders. The number of
+// times the violation was previously applied to an object within Window is used
+// to determine the penalty.
+type Escalation struct {
+	// Window is how long a previous violation counts towards escalation
+	Window time.Duration `json:"window"`
+
+	// Multiplier, if set, multiplies the penalty by this value for each previous
+	// violation within the window.
+	Multiplier float64 `json:"multiplier,omitempty"`
+
+	// Steps, if set, lists the penalty to apply for the first violation within the
+	// window, then the second, and so on. If the list is exhausted the last penalty
+	// is used. Steps takes precedence over Multiplier.
+	Steps []int `json:"steps,omitempty"`
+
+	// SuppressRecovery, if set, suppresses recovery of the reputation for this
+	// duration for each previous violation within the window. The number of
+	// previous violations counted is limited as described for maxOffenses.
+	SuppressRecovery time.Duration `json:"suppress_recovery,omitempty"`
+}
+
+// maxEscalationOffenses is the most previous offenses kept for a violation whose
+// penalty does not reach a fixed maximum, such as one using only SuppressRecovery
+const maxEscalationOffenses = 32
+
+// maxOffenses returns the number of previous offenses for the violation that are
+// kept for an object. Once this many offenses are recorded further offenses no
+// longer change the penalty, so older ones are discarded. At least one offense is
+// always kept, since the most recent offense determines how long the entry is
+// retained.
+func (v *Violation) maxOffenses() int {
+	n := maxEscalationOffenses
+	if v.Escalation == nil {
+		return n
 	}
-	buf, err := sruntime.redis.get(key)
-	if err != nil {
-		return
+	if len(v.Escalation.Steps) > 0 {
+		n = len(v.Escalation.Steps) - 1
+	} else if v.Escalation.Multiplier > 1 {
+		for i := 0; i < maxEscalationOffenses; i++ {
+			if v.penalty(i) >= 100 {
+				n = i
+				break
+			}
+		}
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// penalty returns the penalty for the violation, given the number of times n it
+// was previously applied to the object within the escalation window
+func (v *Violation) penalty(n int) int {
+	if v.Escalation == nil {
+		return v.Penalty
+	}
+	if len(v.Escalation.Steps) > 0 {
+		if n >= len(v.Escalation.Steps) {
+			n = len(v.Escalation.Steps) - 1
+		}
+		return v.Escalation.Steps[n]
+	}
+	if v.Escalation.Multiplier > 0 {
+		p := float64(v.Penalty) * math.Pow(v.Escalation.Multiplier, float64(n))
+		if p > 100 {
+			return 100
+		}
+		return int(math.Round(p))
 	}
+	return v.Penalty
+}
 
-	err = json.Unmarshal(buf, &ret)
+// repDecode unmarshals a stored reputation entry and applies decay to it
+func repDecode(buf []byte, typestr string) (ret Reputation, err error) {
+	var s storedReputation
+	err = json.Unmarshal(buf, &s)
 	if err != nil {
 		return
 	}
+	ret = s.Reputation
+	ret.Offenses = s.Offenses
+	ret.Events = s.Events
+	ret.Sources = s.Sources
+	ret.Deductions = s.Deductions
+
+	// Ignore any band that was stored with the entry, it may no longer match the
+	// score or the configured bands
+	ret.Band, ret.Action = "", ""
 
 	// If the type field is unset in the stored entry, set it to the type that was
 	// used to make the request
@@ -204,41 +683,366 @@ func repGet(typestr string, valstr string) (ret Reputation, err error) {
 	return
 }
 
-func repDelete(typestr string, valstr string) (err error) {
-	key, err := keyFromTypeAndValue(typestr, valstr)
+func repGet(typestr string, valstr string) (ret Reputation, err error) {
+	var key string
+	key, err = keyFromTypeAndValue(typestr, valstr)
 	if err != nil {
-		return err
+		return
+	}
+	buf, err := sruntime.store.Get(key)
+	if err != nil {
+		return
+	}
+	return repDecode(buf, typestr)
+}
+
+// appliedViolation describes the result of applying a violation request to a
+// reputation entry
+type appliedViolation struct {
+	// Request is the violation request that was applied
+	Request ViolationRequest
+
+	// Original is the reputation of the object before the violation was applied.
+	// It is a shallow copy, so it shares the tags, metadata and bookkeeping maps
+	// and slices with the entry the violation is applied to. Methods applying a
+	// violation must therefore replace these rather than modifying them in place.
+	Original Reputation
+
+	// Result is the reputation of the object after the violation was applied
+	Result Reputation
+
+	// Penalty is the penalty that was used when applying the violation, including
+	// any escalation
+	Penalty int
+
+	// OverBudget is set if the penalty was not fully applied because the object
+	// has lost the maximum number of points allowed by the penalty budget
+	OverBudget bool
+
+	// Duplicate is set if the request has an event ID that was already applied to
+	// the object, in which case the violation was not applied again
+	Duplicate bool
+
+	// Err is set if the violation could not be applied, for example if the
+	// existing entry for the object is invalid
+	Err error
+}
+
+// applyViolationRequest applies violation request v to the reputation, including
+// any recovery suppression indicated in the request, and returns the penalty used.
+// The penalty is weighted according to the reporter of the request, and limited is
+// true if the penalty was limited by the penalty budget for the object.
+func (r *Reputation) applyViolationRequest(v ViolationRequest) (penalty int, limited bool, err error) {
+	// If recovery suppression was specified add the correct timestamp to the
+	// reputation entry. Is suppression is already indicated, only update it if it
+	// results in a new timestamp that is beyond what the existing value is.
+	if v.SuppressRecovery > 0 {
+		nd := time.Now().UTC().Add(time.Second *
+			time.Duration(v.SuppressRecovery))
+		if r.DecayAfter.IsZero() || r.DecayAfter.Before(nd) {
+			r.DecayAfter = nd
+		}
+	}
+	r.mergeTags(v.Tags, v.Metadata)
+	r.recordEvent(v.EventID)
+	return r.applyViolation(v.Violation, r.violationWeight(v.reporter, v.Source))
+}
+
+// repApplyViolations applies a batch of violation requests to the stored
+// reputations for the objects in the batch, creating new entries for objects that
+// are not known. The current entries for all objects in the batch are fetched
+// from the store together, the violations are applied in the order they were
+// submitted, and the updated entries are written back together. The update is
+// atomic, so concurrent violations for the same objects are not lost.
+//
+// The requests are expected to have already been validated, and to reference
+// known violations.
+func repApplyViolations(vs []ViolationRequest) (ret []appliedViolation, err error) {
+	keys, keyItems, err := violationKeys(vs)
+	if err != nil || len(keys) == 0 {
+		return
+	}
+	ret = make([]appliedViolation, len(vs))
+	err = sruntime.store.Update(keys, func(i int, cur []byte) (StoreValue, error) {
+		rep, buf := applyStoredViolations(cur, vs, keyItems[i], ret)
+		if buf == nil {
+			return StoreValue{}, nil
+		}
+		return StoreValue{Value: buf, Expiry: rep.expiry()}, nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	_, err = sruntime.redis.del(key).Result()
 	return
 }
 
-func RepDump() (ret []Reputation, err error) {
-	keys, err := sruntime.redis.keys("*").Result()
+// repSimulateViolations returns the results that applying a batch of violation
+// requests would have, without modifying the stored reputations. The violations
+// are applied to the current entries in the same way as repApplyViolations.
+func repSimulateViolations(vs []ViolationRequest) (ret []appliedViolation, err error) {
+	keys, keyItems, err := violationKeys(vs)
+	if err != nil || len(keys) == 0 {
+		return
+	}
+	vals, err := sruntime.store.MGet(keys...)
+	if err != nil {
+		return nil, err
+	}
+	ret = make([]appliedViolation, len(vs))
+	for i, cur := range vals {
+		applyStoredViolations(cur, vs, keyItems[i], ret)
+	}
+	return
+}
+
+// violationKeys returns the set of unique keys the violation requests in vs apply
+// to. Multiple requests may apply to the same object, so the indexes of the
+// requests that apply to each key are also returned.
+func violationKeys(vs []ViolationRequest) (keys []string, keyItems [][]int, err error) {
+	keyIdx := make(map[string]int)
+	for i, v := range vs {
+		k, err := keyFromTypeAndValue(v.Type, v.Object)
+		if err != nil {
+			return nil, nil, err
+		}
+		idx, ok := keyIdx[k]
+		if !ok {
+			idx = len(keys)
+			keyIdx[k] = idx
+			keys = append(keys, k)
+			keyItems = append(keyItems, nil)
+		}
+		keyItems[idx] = append(keyItems[idx], i)
+	}
+	return
+}
+
+// applyStoredViolations applies the violation requests in vs indexed by items,
+// which all apply to the same object, to stored entry cur and records the results
+// in ret. Requests with an event ID that was already applied to the object are
+// marked as duplicates and skipped. The updated entry and its encoded form are
+// returned, and if every request was skipped the encoded form is nil since the
+// entry does not need to be updated. If the existing entry could not be loaded or
+// updated every request for the object is failed and nil is returned.
+func applyStoredViolations(cur []byte, vs []ViolationRequest, items []int, ret []appliedViolation) (*Reputation, []byte) {
+	fail := func(err error) (*Reputation, []byte) {
+		for _, j := range items {
+			ret[j] = appliedViolation{Request: vs[j], Err: err}
+		}
+		return nil, nil
+	}
+	rep, err := repFromStored(cur, vs[items[0]])
+	if err != nil {
+		return fail(err)
+	}
+	applied := 0
+	for _, j := range items {
+		// Shallow copy, see appliedViolation.Original
+		ret[j] = appliedViolation{Request: vs[j], Original: *rep}
+		if rep.seenEvent(vs[j].EventID) {
+			ret[j].Duplicate = true
+			ret[j].Result = *rep
+			continue
+		}
+		ret[j].Penalty, ret[j].OverBudget, err = rep.applyViolationRequest(vs[j])
+		if err != nil {
+			return fail(err)
+		}
+		ret[j].Result = *rep
+		applied++
+	}
+	if applied == 0 {
+		return rep, nil
+	}
+	_, buf, err := rep.encode()
+	if err != nil {
+		return fail(err)
+	}
+	for _, j := range items {
+		ret[j].Result.LastUpdated = rep.LastUpdated
+	}
+	return rep, buf
+}
+
+// repFromStored returns the reputation for the object in violation request v
+// from stored entry buf, or a new entry if buf is nil
+func repFromStored(buf []byte, v ViolationRequest) (*Reputation, error) {
+	if buf == nil {
+		obj, err := normalizedObjectValue(v.Type, v.Object)
+		if err != nil {
+			return nil, err
+		}
+		return &Reputation{Object: obj, Type: v.Type, Reputation: 100}, nil
+	}
+	rep, err := repDecode(buf, v.Type)
+	if err != nil {
+		return nil, err
+	}
+	err = rep.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &rep, nil
+}
+
+// repPin pins the reputation for an object to score rep, creating a new entry if
+// the object is not known. The pin is removed after expires, unless expires is the
+// zero value. The updated reputation is returned.
+func repPin(typestr string, valstr string, rep int, expires time.Time, reason string) (ret Reputation, err error) {
+	key, err := keyFromTypeAndValue(typestr, valstr)
 	if err != nil {
 		return
 	}
+	err = sruntime.store.Update([]string{key}, func(i int, cur []byte) (StoreValue, error) {
+		r, err := repFromStored(cur, ViolationRequest{Type: typestr, Object: valstr})
+		if err != nil {
+			return StoreValue{}, err
+		}
+		r.pin(rep, expires, reason)
+		_, buf, err := r.encode()
+		if err != nil {
+			return StoreValue{}, err
+		}
+		ret = *r
+		return StoreValue{Value: buf, Expiry: r.expiry()}, nil
+	})
+	return
+}
 
-	// Collect and return all entries from the database; note that this is a raw dump
-	// and no compatibility fixups or any validation occurs on the returned entries.
-	for _, obj := range keys {
-		buf, err := sruntime.redis.get(obj)
+// repUnpin removes the pin from the reputation for an object, returning
+// ErrNotFound if the object is not known
+func repUnpin(typestr string, valstr string) error {
+	key, err := keyFromTypeAndValue(typestr, valstr)
+	if err != nil {
+		return err
+	}
+	return sruntime.store.Update([]string{key}, func(i int, cur []byte) (StoreValue, error) {
+		if cur == nil {
+			return StoreValue{}, ErrNotFound
+		}
+		r, err := repFromStored(cur, ViolationRequest{Type: typestr, Object: valstr})
 		if err != nil {
-			return ret, err
+			return StoreValue{}, err
 		}
-		reputation := Reputation{}
-		err = json.Unmarshal(buf, &reputation)
+		r.unpin()
+		_, buf, err := r.encode()
 		if err != nil {
-			return ret, err
+			return StoreValue{}, err
 		}
+		return StoreValue{Value: buf, Expiry: r.expiry()}, nil
+	})
+}
 
-		err = reputation.applyDecay()
+// repSet stores rep as the reputation entry for its object, replacing any existing
+// entry. The violation bookkeeping is never taken from rep. If there is an existing
+// entry its bookkeeping is kept, so setting a reputation can't be used to reset
+// escalation, idempotency, corroboration or the penalty budget for the object.
+// The object in rep is normalized.
+func repSet(rep *Reputation) (err error) {
+	rep.Object, err = normalizedObjectValue(rep.Type, rep.Object)
+	if err != nil {
+		return err
+	}
+	key, err := keyFromTypeAndValue(rep.Type, rep.Object)
+	if err != nil {
+		return err
+	}
+	return sruntime.store.Update([]string{key}, func(i int, cur []byte) (StoreValue, error) {
+		r := *rep
+		r.Offenses, r.Events, r.Sources, r.Deductions = nil, nil, nil, nil
+		if cur != nil {
+			// An existing entry that can't be decoded is replaced entirely
+			old, err := repDecode(cur, rep.Type)
+			if err == nil {
+				r.Offenses, r.Events = old.Offenses, old.Events
+				r.Sources, r.Deductions = old.Sources, old.Deductions
+			}
+		}
+		_, buf, err := r.encode()
 		if err != nil {
-			return ret, err
+			return StoreValue{}, err
 		}
+		return StoreValue{Value: buf, Expiry: r.expiry()}, nil
+	})
+}
 
-		ret = append(ret, reputation)
+func repDelete(typestr string, valstr string) (err error) {
+	key, err := keyFromTypeAndValue(typestr, valstr)
+	if err != nil {
+		return err
 	}
+	return sruntime.store.Delete(key, historyKey(key))
+}
+
+// dumpBatchSize is the number of keys requested from the store in each batch while
+// iterating over all entries
+const dumpBatchSize = 1000
 
+// RepDump returns all reputation entries in the store. Since this loads every
+// entry into memory, RepDumpFunc should be preferred for large datasets.
+func RepDump() (ret []Reputation, err error) {
+	err = RepDumpFunc(func(r Reputation) error {
+		ret = append(ret, r)
+		return nil
+	})
 	return
 }
+
+// RepDumpFunc calls fn for every reputation entry in the store. Entries are
+// fetched from the store in batches as iteration progresses, so the full dataset
+// is never held in memory. If fn returns an error iteration stops and the error
+// is returned.
+func RepDumpFunc(fn func(Reputation) error) error {
+	return RepDumpTagsFunc(nil, fn)
+}
+
+// RepDumpTagsFunc is like RepDumpFunc, but only calls fn for entries that have
+// all of the specified tags.
+func RepDumpTagsFunc(tags []string, fn func(Reputation) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := sruntime.store.Scan(cursor, "*", dumpBatchSize)
+		if err != nil {
+			return err
+		}
+		// Skip keys that hold other data, such as violation history
+		n := 0
+		for _, k := range keys {
+			if !isAuxKey(k) {
+				keys[n] = k
+				n++
+			}
+		}
+		keys = keys[:n]
+		if len(keys) > 0 {
+			vals, err := sruntime.store.MGet(keys...)
+			if err != nil {
+				return err
+			}
+			// Note that this is a raw dump and no compatibility fixups or any
+			// validation occurs on the returned entries.
+			for _, buf := range vals {
+				// The key may have expired or been removed since it was returned
+				// by the scan
+				if buf == nil {
+					continue
+				}
+				reputation, err := repDecode(buf, "")
+				if err != nil {
+					return err
+				}
+				if !reputation.HasTags(tags...) {
+					continue
+				}
+				err = fn(reputation)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
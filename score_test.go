@@ -0,0 +1,261 @@
+package iprepd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReputationExpiry(t *testing.T) {
+	origDecay := sruntime.cfg.Decay
+	origRetention := sruntime.cfg.Retention
+	defer func() {
+		sruntime.cfg.Decay = origDecay
+		sruntime.cfg.Retention = origRetention
+	}()
+	sruntime.cfg.Decay.Points = 1
+	sruntime.cfg.Decay.Interval = time.Minute
+	sruntime.cfg.Retention.Default = time.Hour * 336
+	sruntime.cfg.Retention.Recovered = time.Hour
+	sruntime.cfg.Retention.Types = map[string]time.Duration{TypeEmail: time.Hour * 2160}
+
+	now := time.Now().UTC()
+	tests := []struct {
+		Name   string
+		Rep    Reputation
+		Expiry time.Duration
+	}{
+		{
+			Name:   "recovered",
+			Rep:    Reputation{Type: TypeIP, Reputation: 100},
+			Expiry: time.Hour,
+		},
+		{
+			Name:   "recovering",
+			Rep:    Reputation{Type: TypeIP, Reputation: 50},
+			Expiry: time.Minute*50 + time.Hour,
+		},
+		{
+			Name:   "reviewed",
+			Rep:    Reputation{Type: TypeIP, Reputation: 100, Reviewed: true},
+			Expiry: time.Hour * 336,
+		},
+		{
+			Name:   "type retention",
+			Rep:    Reputation{Type: TypeEmail, Reputation: 0, Reviewed: true},
+			Expiry: time.Hour * 2160,
+		},
+		{
+			Name:   "decay after",
+			Rep:    Reputation{Type: TypeIP, Reputation: 50, DecayAfter: now.Add(time.Hour * 5)},
+			Expiry: time.Hour * 6,
+		},
+		{
+			Name:   "decay after beyond retention",
+			Rep:    Reputation{Type: TypeIP, Reputation: 0, Reviewed: true, DecayAfter: now.Add(time.Hour * 500)},
+			Expiry: time.Hour * 500,
+		},
+	}
+	for _, tst := range tests {
+		tst.Rep.LastUpdated = now
+		assert.InDelta(t, float64(tst.Expiry), float64(tst.Rep.expiry()),
+			float64(time.Second), tst.Name)
+	}
+
+	// Without decay an entry never recovers, so the retention period applies
+	sruntime.cfg.Decay.Points = 0
+	r := Reputation{Type: TypeIP, Reputation: 50, LastUpdated: now}
+	assert.InDelta(t, float64(time.Hour*336), float64(r.expiry()), float64(time.Second))
+}
+
+func TestReputationStoredExpiry(t *testing.T) {
+	err := baseTest()
+	assert.Nil(t, err)
+
+	r := Reputation{Object: "192.168.20.1", Type: TypeIP, Reputation: 100}
+	assert.Nil(t, r.set())
+	ttl, err := sruntime.store.TTL("ip 192.168.20.1")
+	assert.Nil(t, err)
+	assert.True(t, ttl > 0 && ttl <= sruntime.cfg.Retention.Recovered)
+
+	r = Reputation{Object: "usr@mozilla.com", Type: TypeEmail, Reputation: 100, Reviewed: true}
+	assert.Nil(t, r.set())
+	ttl, err = sruntime.store.TTL("email usr@mozilla.com")
+	assert.Nil(t, err)
+	assert.True(t, ttl > sruntime.cfg.Retention.Recovered)
+	assert.True(t, ttl <= sruntime.cfg.Retention.Default)
+}
+
+func TestViolationPenalty(t *testing.T) {
+	tests := []struct {
+		Violation Violation
+		N         int
+		Penalty   int
+	}{
+		{Violation{Penalty: 10}, 3, 10},
+		{Violation{Penalty: 10, Escalation: &Escalation{Window: time.Hour}}, 3, 10},
+		{Violation{Penalty: 10, Escalation: &Escalation{Window: time.Hour, Multiplier: 2}}, 0, 10},
+		{Violation{Penalty: 10, Escalation: &Escalation{Window: time.Hour, Multiplier: 2}}, 2, 40},
+		{Violation{Penalty: 10, Escalation: &Escalation{Window: time.Hour, Multiplier: 2}}, 10, 100},
+		{Violation{Penalty: 10, Escalation: &Escalation{Window: time.Hour, Multiplier: 1.5}}, 1, 15},
+		{Violation{Penalty: 10, Escalation: &Escalation{Window: time.Hour, Steps: []int{5, 20, 50}}}, 0, 5},
+		{Violation{Penalty: 10, Escalation: &Escalation{Window: time.Hour, Steps: []int{5, 20, 50}}}, 1, 20},
+		{Violation{Penalty: 10, Escalation: &Escalation{Window: time.Hour, Steps: []int{5, 20, 50}}}, 5, 50},
+	}
+	for i, tst := range tests {
+		assert.Equal(t, tst.Penalty, tst.Violation.penalty(tst.N), i)
+	}
+}
+
+func TestViolationMaxOffenses(t *testing.T) {
+	tests := []struct {
+		Violation Violation
+		Max       int
+	}{
+		{Violation{Penalty: 10, Escalation: &Escalation{Window: time.Hour}}, maxEscalationOffenses},
+		{Violation{Penalty: 10, Escalation: &Escalation{Window: time.Hour, Multiplier: 2}}, 4},
+		{Violation{Penalty: 10, Escalation: &Escalation{Window: time.Hour, Multiplier: 0.5}}, maxEscalationOffenses},
+		{Violation{Penalty: 0, Escalation: &Escalation{Window: time.Hour, Multiplier: 2}}, maxEscalationOffenses},
+		{Violation{Penalty: 10, Escalation: &Escalation{Window: time.Hour, Steps: []int{5, 20, 50}}}, 2},
+		{Violation{Penalty: 10, Escalation: &Escalation{Window: time.Hour, Steps: []int{5}}}, 1},
+	}
+	for i, tst := range tests {
+		assert.Equal(t, tst.Max, tst.Violation.maxOffenses(), i)
+	}
+}
+
+func TestEscalation(t *testing.T) {
+	assert.Nil(t, baseTest())
+	origViolations := sruntime.cfg.Violations
+	defer func() { sruntime.cfg.Violations = origViolations }()
+	sruntime.cfg.Violations = append([]Violation{
+		{
+			Name:    "escalate1",
+			Penalty: 10,
+			Escalation: &Escalation{
+				Window:           time.Hour * 24,
+				Multiplier:       2,
+				SuppressRecovery: time.Hour,
+			},
+		},
+		{
+			Name:       "escalate2",
+			Escalation: &Escalation{Window: time.Hour * 24, Steps: []int{5, 30}},
+		},
+	}, origViolations...)
+
+	apply := func(object string, violation string) ViolationResult {
+		res, err := applyViolationRequests(TypeIP, "", []ViolationRequest{
+			{Object: object, Type: TypeIP, Violation: violation},
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, ViolationStatusApplied, res[0].Status)
+		return res[0]
+	}
+
+	// The penalty doubles for each repeat offense, and recovery is suppressed
+	// for longer each time
+	res := apply("192.168.30.1", "escalate1")
+	assert.Equal(t, 90, res.Reputation.Reputation)
+	assert.True(t, res.Reputation.DecayAfter.IsZero())
+	res = apply("192.168.30.1", "escalate1")
+	assert.Equal(t, 70, res.Reputation.Reputation)
+	assert.InDelta(t, float64(time.Hour), float64(time.Until(res.Reputation.DecayAfter)),
+		float64(time.Minute))
+	res = apply("192.168.30.1", "escalate1")
+	assert.Equal(t, 30, res.Reputation.Reputation)
+	assert.InDelta(t, float64(time.Hour*2), float64(time.Until(res.Reputation.DecayAfter)),
+		float64(time.Minute))
+	assert.Equal(t, 3, len(res.Reputation.Offenses["escalate1"]))
+
+	// Violations without escalation should not be tracked or escalated
+	res = apply("192.168.30.1", "violation1")
+	assert.Equal(t, 25, res.Reputation.Reputation)
+	_, ok := res.Reputation.Offenses["violation1"]
+	assert.False(t, ok)
+
+	// Each violation is escalated independently
+	res = apply("192.168.30.2", "escalate2")
+	assert.Equal(t, 95, res.Reputation.Reputation)
+	res = apply("192.168.30.2", "escalate1")
+	assert.Equal(t, 85, res.Reputation.Reputation)
+	res = apply("192.168.30.2", "escalate2")
+	assert.Equal(t, 55, res.Reputation.Reputation)
+	res = apply("192.168.30.2", "escalate2")
+	assert.Equal(t, 25, res.Reputation.Reputation)
+
+	// Only as many offenses as can change the penalty should be kept
+	assert.Equal(t, 1, len(res.Reputation.Offenses["escalate2"]))
+	for i := 0; i < 3; i++ {
+		res = apply("192.168.30.1", "escalate1")
+	}
+	assert.Equal(t, 4, len(res.Reputation.Offenses["escalate1"]))
+	assert.InDelta(t, float64(time.Hour*4), float64(time.Until(res.Reputation.DecayAfter)),
+		float64(time.Minute))
+
+	// The escalated penalty should be recorded in the history
+	h, err := historyGet(TypeIP, "192.168.30.2")
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(h))
+	assert.Equal(t, []int{5, 10, 30, 30},
+		[]int{h[0].Penalty, h[1].Penalty, h[2].Penalty, h[3].Penalty})
+
+	// Offenses outside of the window no longer count towards escalation, and the
+	// entry should be retained for as long as offenses are within the window
+	r := Reputation{
+		Object:     "192.168.30.3",
+		Type:       TypeIP,
+		Reputation: 100,
+		Offenses: map[string][]time.Time{
+			"escalate1": {
+				time.Now().UTC().Add(-time.Hour * 48),
+				time.Now().UTC().Add(-time.Hour * 2),
+			},
+		},
+	}
+	assert.Nil(t, r.set())
+	ttl, err := sruntime.store.TTL("ip 192.168.30.3")
+	assert.Nil(t, err)
+	assert.InDelta(t, float64(time.Hour*22), float64(ttl), float64(time.Minute))
+	res = apply("192.168.30.3", "escalate1")
+	assert.Equal(t, 80, res.Reputation.Reputation)
+	assert.Equal(t, 2, len(res.Reputation.Offenses["escalate1"]))
+}
+
+func TestPinExpiry(t *testing.T) {
+	sruntime.cfg.Decay.Points = 1
+	sruntime.cfg.Decay.Interval = time.Minute
+	defer func() {
+		sruntime.cfg.Decay.Points = 0
+	}()
+
+	now := time.Now().UTC()
+	r := Reputation{Object: "192.168.0.1", Type: TypeIP, LastUpdated: now}
+	r.pin(50, now.Add(time.Hour), "")
+	assert.True(t, r.IsPinned())
+	assert.Nil(t, r.applyDecay())
+	assert.Equal(t, 50, r.Reputation)
+	_, _, err := r.applyViolation("violation1", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 50, r.Reputation)
+
+	// The entry can not recover before the pin expires
+	at, ok := r.recoveredAt()
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(time.Hour), at)
+
+	// An expired pin is removed when decay is applied
+	r.PinExpires = now.Add(-time.Minute)
+	r.LastUpdated = now.Add(-time.Minute * 10)
+	assert.False(t, r.IsPinned())
+	assert.Nil(t, r.applyDecay())
+	assert.False(t, r.Pinned)
+	assert.Equal(t, 60, r.Reputation)
+
+	// An indefinite pin never recovers
+	r.pin(50, time.Time{}, "")
+	_, ok = r.recoveredAt()
+	assert.False(t, ok)
+	assert.Equal(t, time.Duration(0), r.expiry())
+}
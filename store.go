@@ -0,0 +1,185 @@
+package iprepd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// BackendRedis is the backend name for the Redis store
+	BackendRedis = "redis"
+
+	// BackendMemory is the backend name for the in-process memory store
+	BackendMemory = "memory"
+)
+
+// ErrNotFound is returned by a Store if a requested key does not exist
+var ErrNotFound = errors.New("key not found")
+
+// Store describes a storage backend for reputation entries. Values are opaque
+// byte slices keyed by the string returned from keyFromTypeAndValue.
+type Store interface {
+	// Get returns the value stored for key k, or ErrNotFound if the key does
+	// not exist.
+	Get(k string) ([]byte, error)
+
+	// MGet returns the values stored for each of the keys in k, in the same order
+	// as the keys were specified. If a key does not exist, the corresponding value
+	// will be nil.
+	MGet(k ...string) ([][]byte, error)
+
+	// Set stores value v for key k. If e is non-zero the key will expire after
+	// the indicated duration.
+	Set(k string, v []byte, e time.Duration) error
+
+	// Update atomically modifies the values stored for the keys in k. fn is
+	// called for each key with the index of the key in k and its current value,
+	// or nil if the key does not exist, and returns the new value for the key. If
+	// the Value field of the returned StoreValue is nil the key is left unchanged.
+	// fn may be called more than once for a key if the update conflicts with a
+	// concurrent modification, and must not call into the store.
+	//
+	// Each key is updated atomically, however a store may update subsets of the
+	// keys in separate transactions (for example, keys that reside on different
+	// nodes of a cluster). If fn returns an error the update is aborted and the
+	// error returned, but keys already updated in another transaction are not
+	// rolled back.
+	Update(k []string, fn func(i int, cur []byte) (StoreValue, error)) error
+
+	// Delete removes the specified keys. Keys that do not exist are ignored.
+	Delete(k ...string) error
+
+	// Scan iterates over the keys in the store matching the glob style pattern
+	// match. Scanning starts with a cursor of 0, and each call returns a batch of
+	// keys along with the cursor to use in the next call. Iteration is complete
+	// when the returned cursor is 0. count is a hint for how many keys should be
+	// returned in each batch.
+	Scan(cursor uint64, match string, count int64) (keys []string, next uint64, err error)
+
+	// TTL returns the remaining time to live for key k. If the key exists but has
+	// no expiry, 0 is returned. If the key does not exist, ErrNotFound is returned.
+	TTL(k string) (time.Duration, error)
+
+	// Ping verifies the store is available.
+	Ping() error
+
+	// Close releases any resources held by the store. Stores that persist their
+	// contents write any pending data before returning.
+	Close() error
+}
+
+// StoreValue is a value to be written to a Store by Update
+type StoreValue struct {
+	// Value is the value to store
+	Value []byte
+
+	// Expiry is the duration after which the key will expire, or 0 if the key
+	// should not expire
+	Expiry time.Duration
+}
+
+// SetStore replaces the storage backend in use by iprepd. This can be used to
+// run iprepd against a backend other than the one created from the configuration
+// file, and should be called before the API is started.
+func SetStore(s Store) {
+	sruntime.store = s
+}
+
+// newStore creates the Store indicated by the backend configuration
+func newStore(cfg ServerCfg) (ret Store, err error) {
+	switch cfg.Backend {
+	case BackendMemory:
+		ret, err = newMemoryStore(cfg)
+	case BackendRedis:
+		ret, err = newRedisLink(cfg)
+	default:
+		return nil, fmt.Errorf("invalid backend %v", cfg.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cfg.KeyPrefix != "" {
+		ret = newPrefixStore(ret, cfg.KeyPrefix)
+	}
+	return ret, nil
+}
+
+// prefixStore wraps a Store, adding a prefix to every key. This allows multiple
+// deployments of iprepd to share the same backend, with each deployment only
+// seeing its own keys.
+type prefixStore struct {
+	store  Store
+	prefix string
+}
+
+func newPrefixStore(s Store, prefix string) *prefixStore {
+	return &prefixStore{store: s, prefix: prefix}
+}
+
+func (p *prefixStore) keys(k []string) []string {
+	ret := make([]string, len(k))
+	for i, x := range k {
+		ret[i] = p.prefix + x
+	}
+	return ret
+}
+
+func (p *prefixStore) Get(k string) ([]byte, error) {
+	return p.store.Get(p.prefix + k)
+}
+
+func (p *prefixStore) MGet(k ...string) ([][]byte, error) {
+	return p.store.MGet(p.keys(k)...)
+}
+
+func (p *prefixStore) Set(k string, v []byte, e time.Duration) error {
+	return p.store.Set(p.prefix+k, v, e)
+}
+
+func (p *prefixStore) Update(k []string, fn func(int, []byte) (StoreValue, error)) error {
+	return p.store.Update(p.keys(k), fn)
+}
+
+func (p *prefixStore) Delete(k ...string) error {
+	return p.store.Delete(p.keys(k)...)
+}
+
+// Scan only returns keys that begin with the prefix, with the prefix removed
+func (p *prefixStore) Scan(cursor uint64, match string, count int64) ([]string, uint64, error) {
+	keys, next, err := p.store.Scan(cursor, globEscape(p.prefix)+match, count)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range keys {
+		keys[i] = strings.TrimPrefix(keys[i], p.prefix)
+	}
+	return keys, next, nil
+}
+
+func (p *prefixStore) TTL(k string) (time.Duration, error) {
+	return p.store.TTL(p.prefix + k)
+}
+
+func (p *prefixStore) Ping() error {
+	return p.store.Ping()
+}
+
+func (p *prefixStore) Close() error {
+	return p.store.Close()
+}
+
+// globEscape escapes any characters in s that have a special meaning in a Redis
+// glob style pattern
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,63 @@
+package iprepd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixStore(t *testing.T) {
+	m := newTestMemoryStore(t, "")
+	p := newPrefixStore(m, "prod*:")
+
+	// Keys belonging to another deployment sharing the store
+	assert.Nil(t, m.Set("ip 10.0.0.1", []byte("other"), 0))
+	assert.Nil(t, m.Set("staging:ip 10.0.0.1", []byte("other"), 0))
+
+	assert.Nil(t, p.Set("ip 10.0.0.1", []byte("a"), 0))
+	assert.Nil(t, p.Set("ip 10.0.0.2", []byte("b"), 0))
+	buf, err := m.Get("prod*:ip 10.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), buf)
+	buf, err = p.Get("ip 10.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), buf)
+
+	vals, err := p.MGet("ip 10.0.0.1", "ip 10.0.0.3", "ip 10.0.0.2")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), nil, []byte("b")}, vals)
+
+	err = p.Update([]string{"ip 10.0.0.2", "ip 10.0.0.3"}, func(i int, cur []byte) (StoreValue, error) {
+		return StoreValue{Value: append(cur, 'c')}, nil
+	})
+	assert.Nil(t, err)
+	buf, err = m.Get("prod*:ip 10.0.0.2")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bc"), buf)
+	buf, err = m.Get("prod*:ip 10.0.0.3")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("c"), buf)
+
+	// Scans should only return keys with the prefix, and the prefix should be
+	// removed from the returned keys
+	keys, cursor, err := p.Scan(0, "*", 100)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), cursor)
+	assert.Equal(t, []string{"ip 10.0.0.1", "ip 10.0.0.2", "ip 10.0.0.3"}, keys)
+
+	assert.Nil(t, p.Delete("ip 10.0.0.1"))
+	_, err = p.Get("ip 10.0.0.1")
+	assert.Equal(t, ErrNotFound, err)
+	buf, err = m.Get("ip 10.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("other"), buf)
+	_, err = p.TTL("ip 10.0.0.1")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestGlobEscape(t *testing.T) {
+	assert.Equal(t, "prod:", globEscape("prod:"))
+	assert.Equal(t, "a\\*b\\?c\\[d\\]\\\\", globEscape("a*b?c[d]\\"))
+	assert.True(t, globMatch(globEscape("a*b?")+"*", "a*b?c"))
+	assert.False(t, globMatch(globEscape("a*b?")+"*", "axbyc"))
+}
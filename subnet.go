@@ -0,0 +1,78 @@
+package iprepd
+
+import (
+	"fmt"
+	"net"
+)
+
+// subnetKey returns the key the aggregate reputation for the network enclosing ip
+// address ipstr is stored under, along with the network in CIDR notation
+func subnetKey(ipstr string) (key string, network string, err error) {
+	ip := net.ParseIP(ipstr)
+	if ip == nil {
+		return "", "", fmt.Errorf("cannot determine network for invalid ip address")
+	}
+	var n net.IPNet
+	if v4 := ip.To4(); v4 != nil {
+		n = net.IPNet{IP: v4, Mask: net.CIDRMask(sruntime.cfg.Subnet.IP4Prefix, 32)}
+	} else {
+		n = net.IPNet{IP: ip, Mask: net.CIDRMask(sruntime.cfg.Subnet.IP6Prefix, 128)}
+	}
+	n.IP = n.IP.Mask(n.Mask)
+	network = n.String()
+	return auxKeyMarker + "subnet " + TypeIP + " " + network, network, nil
+}
+
+// subnetUpdate updates the aggregate reputation for the networks enclosing the
+// addresses in reps. Entries in reps with a nil value remove the address from the
+// network.
+func subnetUpdate(reps map[string]*Reputation) error {
+	if !sruntime.cfg.Subnet.Enable {
+		return nil
+	}
+	return aggregateUpdate(reps, func(obj string) (string, error) {
+		k, _, err := subnetKey(obj)
+		return k, err
+	}, sruntime.cfg.Subnet.MaxAddresses)
+}
+
+// subnetRecord records the results of violations applied to ip addresses in the
+// aggregate reputation for the enclosing networks
+func subnetRecord(applied []appliedViolation) error {
+	return subnetUpdate(aggregateRecord(applied, TypeIP))
+}
+
+// subnetRemove removes ip address ipstr from the aggregate reputation for the
+// enclosing network
+func subnetRemove(ipstr string) error {
+	obj, err := normalizedObjectValue(TypeIP, ipstr)
+	if err != nil {
+		return err
+	}
+	return subnetUpdate(map[string]*Reputation{obj: nil})
+}
+
+// subnetGet returns the aggregate reputation for the network enclosing ip address
+// ipstr. The returned reputation has Network set to the enclosing network. If
+// subnet reputation is disabled or there is no aggregate reputation for the
+// network, ErrNotFound is returned.
+func subnetGet(ipstr string) (ret Reputation, err error) {
+	if !sruntime.cfg.Subnet.Enable {
+		return ret, ErrNotFound
+	}
+	key, network, err := subnetKey(ipstr)
+	if err != nil {
+		return
+	}
+	ret, err = aggregateGet(key, sruntime.cfg.Subnet.MinAddresses)
+	if err != nil {
+		return
+	}
+	ret.Object, err = normalizedObjectValue(TypeIP, ipstr)
+	if err != nil {
+		return
+	}
+	ret.Type = TypeIP
+	ret.Network = network
+	return ret, nil
+}
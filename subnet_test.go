@@ -0,0 +1,109 @@
+package iprepd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubnetKey(t *testing.T) {
+	tests := []struct {
+		IP      string
+		Network string
+	}{
+		{"192.168.50.1", "192.168.50.0/24"},
+		{"192.168.50.254", "192.168.50.0/24"},
+		{"::ffff:192.168.50.1", "192.168.50.0/24"},
+		{"2001:db8:a0b:12f0::1", "2001:db8:a0b::/48"},
+	}
+	for _, tst := range tests {
+		key, network, err := subnetKey(tst.IP)
+		assert.Nil(t, err)
+		assert.Equal(t, tst.Network, network)
+		assert.Equal(t, "_subnet ip "+tst.Network, key)
+	}
+	_, _, err := subnetKey("invalid")
+	assert.NotNil(t, err)
+}
+
+func TestSubnetReputation(t *testing.T) {
+	assert.Nil(t, baseTest())
+	sruntime.cfg.Auth.DisableAuth = true
+	sruntime.cfg.Subnet.Enable = true
+	defer func() { sruntime.cfg.Subnet.Enable = false }()
+	h := mwHandler(newRouter())
+
+	get := func(ip string) (int, Reputation) {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/type/ip/"+ip, nil)
+		h.ServeHTTP(recorder, req)
+		var r Reputation
+		if recorder.Code == http.StatusOK {
+			assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &r))
+		}
+		return recorder.Code, r
+	}
+
+	// Fewer addresses than the minimum have violations, so there should be no
+	// network reputation yet
+	_, err := applyViolationRequests(TypeIP, "", []ViolationRequest{
+		{Object: "192.168.50.1", Violation: "violation2"},
+		{Object: "192.168.50.2", Violation: "violation2"},
+	})
+	assert.Nil(t, err)
+	code, _ := get("192.168.50.100")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	_, err = applyViolationRequests(TypeIP, "", []ViolationRequest{
+		{Object: "192.168.50.3", Violation: "violation1"},
+		{Object: "192.168.50.3", Violation: "violation1"},
+	})
+	assert.Nil(t, err)
+	code, r := get("192.168.50.100")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "192.168.50.100", r.Object)
+	assert.Equal(t, TypeIP, r.Type)
+	assert.Equal(t, 63, r.Reputation)
+	assert.Equal(t, "192.168.50.0/24", r.Network)
+
+	// Addresses with their own entry should return it
+	code, r = get("192.168.50.3")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 90, r.Reputation)
+	assert.Equal(t, "", r.Network)
+
+	// Other networks should be unaffected
+	code, _ = get("192.168.51.1")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// Deleting an address removes it from the network
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("DELETE", "/type/ip/192.168.50.1", nil)
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	code, _ = get("192.168.50.100")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// IPv6 addresses are aggregated by the wider network
+	_, err = applyViolationRequests(TypeIP, "", []ViolationRequest{
+		{Object: "2001:db8:aaa:1::1", Violation: "violation2"},
+		{Object: "2001:db8:aaa:2::1", Violation: "violation2"},
+		{Object: "2001:db8:aaa:3::1", Violation: "violation2"},
+	})
+	assert.Nil(t, err)
+	code, r = get("2001:db8:aaa:4::1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 50, r.Reputation)
+	assert.Equal(t, "2001:db8:aaa:4::", r.Object)
+	assert.Equal(t, "2001:db8:aaa::/48", r.Network)
+
+	// Network entries should not be included in dumps
+	reps, err := RepDump()
+	assert.Nil(t, err)
+	for _, x := range reps {
+		assert.Equal(t, "", x.Network)
+	}
+}
@@ -4,11 +4,167 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"strings"
+	"sync"
 )
 
-var validators = map[string]func(string) error{
-	TypeIP:    validateTypeIP,
-	TypeEmail: validateTypeEmail,
+// objectType describes how objects of a given type are validated and normalized
+type objectType struct {
+	validate  func(string) error
+	normalize func(string) string
+}
+
+var (
+	validatorsLock sync.RWMutex
+	validators     = map[string]objectType{
+		TypeIP:    {validate: validateTypeIP},
+		TypeEmail: {validate: validateTypeEmail},
+	}
+)
+
+// builtinValidators are the validators that can be selected by name for custom
+// object types
+var builtinValidators = map[string]func(string) error{
+	"uuid":     validateUUID,
+	"hexhash":  validateHexHash,
+	"hostname": validateHostname,
+	"integer":  validateInteger,
+	"cidr":     validateCIDR,
+}
+
+// canonicalizers convert values accepted by a built-in validator that have more
+// than one valid form to a single canonical form, so each object has one key.
+// They are applied after any configured normalizations, and return values that
+// are not valid unchanged.
+var canonicalizers = map[string]func(string) string{
+	"cidr": canonicalCIDR,
+}
+
+// normalizers are the normalizations that can be applied to custom object types
+var normalizers = map[string]func(string) string{
+	"trim":      strings.TrimSpace,
+	"lowercase": strings.ToLower,
+	"uppercase": strings.ToUpper,
+}
+
+var (
+	typeNameRe = regexp.MustCompile("^[a-z0-9][a-z0-9_-]{0,63}$")
+	uuidRe     = regexp.MustCompile("^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$")
+	hexHashRe  = regexp.MustCompile("^(?:[0-9a-fA-F]{32}|[0-9a-fA-F]{40}|[0-9a-fA-F]{64}|[0-9a-fA-F]{128})$")
+	hostnameRe = regexp.MustCompile("^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\\.)*" +
+		"[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$")
+	integerRe = regexp.MustCompile("^[0-9]{1,20}$")
+)
+
+// TypeConfig describes a custom object type. Objects are validated using either a
+// regular expression or one of the built-in validators, after any normalizations
+// have been applied.
+type TypeConfig struct {
+	// Regexp is a regular expression objects of the type must match
+	Regexp string
+
+	// Validator is the name of a built-in validator, one of uuid, hexhash,
+	// hostname, integer or cidr. Objects validated as cidr are converted to the
+	// canonical form of the network, so 10.0.0.1/8 is stored as 10.0.0.0/8.
+	Validator string
+
+	// Normalize is a list of normalizations applied to objects of the type, in
+	// order. Valid normalizations are trim, lowercase and uppercase.
+	Normalize []string
+}
+
+// newObjectType returns the object type described by type configuration t
+func newObjectType(name string, t TypeConfig) (ret objectType, err error) {
+	if !typeNameRe.MatchString(name) {
+		return ret, fmt.Errorf("invalid type name %v", name)
+	}
+	switch {
+	case t.Regexp != "" && t.Validator != "":
+		return ret, fmt.Errorf("type %v can not have both a regexp and a validator", name)
+	case t.Regexp != "":
+		re, err := regexp.Compile(t.Regexp)
+		if err != nil {
+			return ret, fmt.Errorf("type %v: %v", name, err)
+		}
+		ret.validate = func(val string) error {
+			if !re.MatchString(val) {
+				return fmt.Errorf("invalid %v format %v", name, val)
+			}
+			return nil
+		}
+	case t.Validator != "":
+		fn, ok := builtinValidators[t.Validator]
+		if !ok {
+			return ret, fmt.Errorf("unknown validator %v for type %v", t.Validator, name)
+		}
+		ret.validate = fn
+	default:
+		return ret, fmt.Errorf("type %v requires a regexp or a validator", name)
+	}
+	var fns []func(string) string
+	for _, n := range t.Normalize {
+		fn, ok := normalizers[n]
+		if !ok {
+			return ret, fmt.Errorf("unknown normalization %v for type %v", n, name)
+		}
+		fns = append(fns, fn)
+	}
+	if fn, ok := canonicalizers[t.Validator]; ok {
+		fns = append(fns, fn)
+	}
+	if len(fns) > 0 {
+		ret.normalize = func(val string) string {
+			for _, fn := range fns {
+				val = fn(val)
+			}
+			return val
+		}
+	}
+	return ret, nil
+}
+
+// RegisterType adds custom object type name to the set of types known to iprepd,
+// replacing any custom type with the same name. The built-in ip and email types
+// can not be replaced. Types configured in the server configuration are
+// registered when the server starts, and programs using the Client should
+// register the same types so objects are validated consistently.
+func RegisterType(name string, t TypeConfig) error {
+	if name == TypeIP || name == TypeEmail {
+		return fmt.Errorf("can not replace built-in type %v", name)
+	}
+	ot, err := newObjectType(name, t)
+	if err != nil {
+		return err
+	}
+	validatorsLock.Lock()
+	validators[name] = ot
+	validatorsLock.Unlock()
+	return nil
+}
+
+// RegisterTypes registers each of the custom object types in types
+func RegisterTypes(types map[string]TypeConfig) error {
+	for k, v := range types {
+		err := RegisterType(k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getType returns the object type registered as t
+func getType(t string) (objectType, bool) {
+	validatorsLock.RLock()
+	defer validatorsLock.RUnlock()
+	ot, ok := validators[t]
+	return ot, ok
+}
+
+// isValidType returns true if t is a registered object type
+func isValidType(t string) bool {
+	_, ok := getType(t)
+	return ok
 }
 
 func validateTypeIP(val string) error {
@@ -26,9 +182,59 @@ func validateTypeEmail(val string) error {
 	return nil
 }
 
+func validateUUID(val string) error {
+	if !uuidRe.MatchString(val) {
+		return fmt.Errorf("invalid uuid format %v", val)
+	}
+	return nil
+}
+
+func validateHexHash(val string) error {
+	if !hexHashRe.MatchString(val) {
+		return fmt.Errorf("invalid hex hash format %v", val)
+	}
+	return nil
+}
+
+func validateHostname(val string) error {
+	if len(val) > 253 || !hostnameRe.MatchString(val) {
+		return fmt.Errorf("invalid hostname format %v", val)
+	}
+	return nil
+}
+
+func validateInteger(val string) error {
+	if !integerRe.MatchString(val) {
+		return fmt.Errorf("invalid integer format %v", val)
+	}
+	return nil
+}
+
+func validateCIDR(val string) error {
+	if _, _, err := net.ParseCIDR(val); err != nil {
+		return fmt.Errorf("invalid cidr format %v", val)
+	}
+	return nil
+}
+
+// canonicalCIDR returns CIDR val in its canonical form, with the host bits of the
+// address cleared, for example 10.0.0.0/8 for 10.0.0.1/8
+func canonicalCIDR(val string) string {
+	_, ipnet, err := net.ParseCIDR(val)
+	if err != nil {
+		return val
+	}
+	return ipnet.String()
+}
+
+// validateType validates val as an object of type t. Any normalization
+// configured for the type is applied before the value is validated.
 func validateType(t string, val string) error {
-	if fn, ok := validators[t]; ok {
-		return fn(val)
+	if ot, ok := getType(t); ok {
+		if ot.normalize != nil {
+			val = ot.normalize(val)
+		}
+		return ot.validate(val)
 	}
 	return fmt.Errorf("unknown type for validation %v", t)
 }
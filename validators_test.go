@@ -66,3 +66,113 @@ func TestValidateType(t *testing.T) {
 		}
 	}
 }
+
+func TestBuiltinValidators(t *testing.T) {
+	tests := []struct {
+		Validator string
+		Object    string
+		Valid     bool
+	}{
+		{"uuid", "f47ac10b-58cc-4372-a567-0e02b2c3d479", true},
+		{"uuid", "F47AC10B-58CC-4372-A567-0E02B2C3D479", true},
+		{"uuid", "f47ac10b58cc4372a5670e02b2c3d479", false},
+		{"hexhash", "d41d8cd98f00b204e9800998ecf8427e", true},
+		{"hexhash", "da39a3ee5e6b4b0d3255bfef95601890afd80709", true},
+		{"hexhash", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", true},
+		{"hexhash", "d41d8cd98f00b204e9800998ecf8427", false},
+		{"hexhash", "z41d8cd98f00b204e9800998ecf8427e", false},
+		{"hostname", "www.mozilla.org", true},
+		{"hostname", "localhost", true},
+		{"hostname", "-bad.mozilla.org", false},
+		{"hostname", "bad..mozilla.org", false},
+		{"integer", "12345", true},
+		{"integer", "-1", false},
+		{"integer", "123456789012345678901", false},
+		{"cidr", "10.0.0.0/8", true},
+		{"cidr", "2001:db8::/32", true},
+		{"cidr", "10.0.0.1", false},
+	}
+	for _, tst := range tests {
+		err := builtinValidators[tst.Validator](tst.Object)
+		assert.Equal(t, tst.Valid, err == nil, tst.Object)
+	}
+}
+
+// unregisterTypes restores the registrations of the named object types once the
+// test completes, so custom types registered by the test don't remain registered
+// for later tests
+func unregisterTypes(t *testing.T, names ...string) {
+	validatorsLock.RLock()
+	prev := make(map[string]objectType)
+	for _, n := range names {
+		if ot, ok := validators[n]; ok {
+			prev[n] = ot
+		}
+	}
+	validatorsLock.RUnlock()
+	t.Cleanup(func() {
+		validatorsLock.Lock()
+		defer validatorsLock.Unlock()
+		for _, n := range names {
+			if ot, ok := prev[n]; ok {
+				validators[n] = ot
+			} else {
+				delete(validators, n)
+			}
+		}
+	})
+}
+
+func TestCanonicalCIDR(t *testing.T) {
+	unregisterTypes(t, "network")
+	assert.Nil(t, RegisterType("network", TypeConfig{Validator: "cidr", Normalize: []string{"trim"}}))
+	tests := []struct {
+		Object    string
+		Canonical string
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8"},
+		{"10.0.0.1/8", "10.0.0.0/8"},
+		{" 10.1.2.3/16 ", "10.1.0.0/16"},
+		{"2001:db8::1/32", "2001:db8::/32"},
+		{"2001:DB8::/32", "2001:db8::/32"},
+	}
+	for _, tst := range tests {
+		assert.Nil(t, validateType("network", tst.Object), tst.Object)
+		v, err := normalizedObjectValue("network", tst.Object)
+		assert.Nil(t, err)
+		assert.Equal(t, tst.Canonical, v, tst.Object)
+	}
+	assert.NotNil(t, validateType("network", "10.0.0.1"))
+}
+
+func TestRegisterType(t *testing.T) {
+	unregisterTypes(t, "device", "account", "Device", "_device")
+	tests := []struct {
+		Name  string
+		Type  TypeConfig
+		Valid bool
+	}{
+		{"device", TypeConfig{Validator: "uuid", Normalize: []string{"trim", "lowercase"}}, true},
+		{"account", TypeConfig{Regexp: "^acct-[0-9]+$"}, true},
+		{"ip", TypeConfig{Validator: "cidr"}, false},
+		{"Device", TypeConfig{Validator: "uuid"}, false},
+		{"_device", TypeConfig{Validator: "uuid"}, false},
+		{"device", TypeConfig{}, false},
+		{"device", TypeConfig{Validator: "uuid", Regexp: ".*"}, false},
+		{"device", TypeConfig{Validator: "unknown"}, false},
+		{"device", TypeConfig{Regexp: "("}, false},
+		{"device", TypeConfig{Validator: "uuid", Normalize: []string{"unknown"}}, false},
+	}
+	for _, tst := range tests {
+		err := RegisterType(tst.Name, tst.Type)
+		assert.Equal(t, tst.Valid, err == nil, tst.Name)
+	}
+
+	assert.True(t, isValidType("device"))
+	assert.Nil(t, validateType("device", " F47AC10B-58CC-4372-A567-0E02B2C3D479 "))
+	v, err := normalizedObjectValue("device", " F47AC10B-58CC-4372-A567-0E02B2C3D479 ")
+	assert.Nil(t, err)
+	assert.Equal(t, "f47ac10b-58cc-4372-a567-0e02b2c3d479", v)
+	assert.Nil(t, validateType("account", "acct-1234"))
+	assert.NotNil(t, validateType("account", "ACCT-1234"))
+}